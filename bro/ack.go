@@ -0,0 +1,194 @@
+package bro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/msg"
+)
+
+// Acknowledged payload is sent as request (msg.Connection.Call) and
+// target broker replies with result of delivery to queue. Brokers
+// forwarding payload relay reply back. If there's no reply in ack timeout
+// payload is sent again (at most ack retries times), so acknowledged
+// message is delivered at least once (but it may be delivered twice
+// if acknowledgement is lost). Sender tells in payload how long it waits
+// for reply and each forwarding broker waits shorter time, so that
+// relayed reply reaches sender before it times out.
+
+// default acknowledgement settings
+const (
+	defaultAckTimeout = time.Second
+	defaultAckRetries = 2
+)
+
+// forwarding broker waits reply at most this part (percent)
+// of time which sender waits
+const ackHopPercent = 75
+
+// result of successful delivery in acknowledgement
+// (otherwise error code is used)
+const ackDelivered = "delivered"
+
+type ackMsg struct {
+	Result string `json:"result"`
+}
+
+type ackConfig struct {
+	timeout time.Duration
+	retries int
+}
+
+func ackOptions(options map[string]interface{}) (ackConfig, error) {
+	config := ackConfig{timeout: defaultAckTimeout, retries: defaultAckRetries}
+	if v, found := options["ack-timeout"]; found {
+		timeout, ok := v.(int)
+		if !ok || timeout <= 0 {
+			return config, fmt.Errorf("Invalid format for ack-timeout")
+		}
+		config.timeout = time.Duration(timeout)
+	}
+	if v, found := options["ack-retries"]; found {
+		retries, ok := v.(int)
+		if !ok || retries < 0 {
+			return config, fmt.Errorf("Invalid format for ack-retries")
+		}
+		config.retries = retries
+	}
+	return config, nil
+}
+
+// SendMsgAcked sends message like SendMsg but waits until target broker
+// acknowledges that message is put to queue, ErrQueueNotFound or ErrQueueFull
+// is returned if target broker couldn't deliver message. Sending is retried
+// if acknowledgement is not received in time (error is msg.ErrTimeout
+// if all retries fail).
+func (broker *Broker) SendMsgAcked(nodeName, queueName string, data []byte) error {
+	if broker.isClosed() {
+		return ErrBrokerClosed
+	}
+	if nodeName == broker.OwnName {
+		return broker.SendMsg(nodeName, queueName, data)
+	}
+
+	payloadmsg := msgFormat{
+		MsgName:     "payload",
+		TargetQName: queueName,
+		PayloadData: data,
+		Target:      nodeName,
+		Hops:        broker.maxHops,
+		AckTimeout:  broker.ack.timeout,
+	}
+	var err error
+	for attempt := 0; attempt <= broker.ack.retries; attempt++ {
+		if attempt > 0 && !errors.Is(err, msg.ErrTimeout) {
+			// wait before retrying if peer was not reachable
+			select {
+			case <-time.After(broker.ack.timeout):
+			case <-broker.stop:
+				return ErrBrokerClosed
+			}
+		}
+		if broker.isClosed() {
+			return ErrBrokerClosed
+		}
+
+		var con *msg.Connection
+		con, err = broker.nextHop(nodeName)
+		if err == nil {
+			var reply string
+			reply, err = broker.callPayload(con, payloadmsg)
+			if err == nil {
+				return ackResult(reply, queueName)
+			}
+			if errors.Is(err, ErrEncodeFailed) {
+				return err
+			}
+		}
+		broker.log(msg.LevelDebug, "Acked send failed", "peer", nodeName, "queue", queueName, "attempt", attempt+1, "error", err)
+	}
+	if errors.Is(err, msg.ErrTimeout) {
+		return fmt.Errorf("No acknowledgement from %s: %w", nodeName, err)
+	}
+	return err
+}
+
+// callPayload sends payload as request and waits for reply
+// at most time given in payload
+func (broker *Broker) callPayload(con *msg.Connection, payloadmsg msgFormat) (string, error) {
+	payloadMsgData, err := json.Marshal(&payloadmsg)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrEncodeFailed, err)
+	}
+	return con.CallTimeout(string(payloadMsgData), payloadmsg.AckTimeout)
+}
+
+// hopAckTimeout returns time which forwarding broker waits for reply
+// when sender waits given time (own ack timeout is used for senders
+// which don't tell it)
+func (broker *Broker) hopAckTimeout(senderTimeout time.Duration) time.Duration {
+	if senderTimeout <= 0 {
+		senderTimeout = broker.ack.timeout
+	}
+	return senderTimeout * ackHopPercent / 100
+}
+
+// ackResult returns error matching to result in acknowledgement
+func ackResult(reply, queueName string) error {
+	var ack ackMsg
+	if err := json.Unmarshal([]byte(reply), &ack); err != nil {
+		return fmt.Errorf("Invalid acknowledgement: %v", err)
+	}
+	switch ack.Result {
+	case ackDelivered:
+		return nil
+	case CodeQueueNotFound:
+		return fmt.Errorf("%w (%s)", ErrQueueNotFound, queueName)
+	case CodeQueueFull:
+		return fmt.Errorf("%w (%s)", ErrQueueFull, queueName)
+	}
+	return fmt.Errorf("Delivery failed (%s)", ack.Result)
+}
+
+// sendAck replies to acknowledged payload with result of delivery
+func (broker *Broker) sendAck(request msg.Msg, err error) {
+	result := ackDelivered
+	if err != nil {
+		result = ErrorCode(err)
+	}
+	ackData, err := json.Marshal(&ackMsg{Result: result})
+	if err != nil {
+		broker.log(msg.LevelError, "Marshal failed", "error", err)
+		return
+	}
+	if err := broker.Server.Reply(request, string(ackData)); err != nil {
+		broker.log(msg.LevelDebug, "Ack send failed", "addr", request.FromAddr, "error", err)
+	}
+}
+
+// forwardAcked forwards acknowledged payload towards target broker and
+// relays acknowledgement back, if forwarding fails there's no reply and
+// sender retries
+func (broker *Broker) forwardAcked(request msg.Msg, msgform msgFormat) {
+	msgform.Hops--
+	if msgform.Hops <= 0 {
+		broker.log(msg.LevelWarn, "Hop limit reached, dropping", "peer", msgform.Target, "queue", msgform.TargetQName)
+		return
+	}
+	con, err := broker.nextHop(msgform.Target)
+	if err != nil {
+		broker.log(msg.LevelDebug, "No route, dropping", "peer", msgform.Target, "queue", msgform.TargetQName, "error", err)
+		return
+	}
+	msgform.AckTimeout = broker.hopAckTimeout(msgform.AckTimeout)
+	reply, err := broker.callPayload(con, msgform)
+	if err != nil {
+		broker.log(msg.LevelDebug, "Forwarding failed", "peer", msgform.Target, "queue", msgform.TargetQName, "error", err)
+		return
+	}
+	if err := broker.Server.Reply(request, reply); err != nil {
+		broker.log(msg.LevelDebug, "Ack relay failed", "addr", request.FromAddr, "error", err)
+	}
+}
@@ -3,20 +3,15 @@ package bro
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/anssihalmeaho/mzq/msg"
 	"github.com/anssihalmeaho/mzq/queue"
 )
 
-const debugPrintingOn = false
-
-func debugPrint(args ...interface{}) {
-	if debugPrintingOn {
-		fmt.Println(args...)
-	}
-}
-
 type peerState int
 
 const (
@@ -32,22 +27,53 @@ type peerInfo struct {
 	recAddr string
 	conn    *msg.Connection
 	state   peerState
+
+	// listening addresses advertised by peer
+	addrs []string
+
+	// discovered by gossip (not in configured addresses)
+	discovered bool
+
+	// time when peer came up and messages received from peer
+	since     time.Time
+	recvMsgs  int
+	recvBytes int
 }
 
 // Broker ...
 type Broker struct {
-	OwnName   string
-	OwnAddr   string
-	Server    *msg.MessageServer
+	OwnName string
+	OwnAddr string
+	Server  *msg.MessageServer
+
+	// Deprecated: use PeerInfo to get information about peers
 	Peers     *PeerStore
 	RegCh     chan queueReg
 	PayloadCh chan payloadMsg
 	Decoder   func([]byte) interface{}
+
+	reconnectInterval time.Duration
+	members           *membership
+	routes            *routeTable
+	routeTrigger      chan struct{}
+	memberTrigger     chan struct{}
+	maxHops           int
+	ack               ackConfig
+	peerEvents        chan PeerEvent
+	watchers          []func(PeerEvent)
+	watchLock         sync.Mutex
+	closeQueues       bool
+	stop              chan struct{}
+	closeOnce         sync.Once
+	wg                sync.WaitGroup
 }
 
+// payloadMsg is delivered to local queue, result of
+// delivery is sent to replyCh if it's given
 type payloadMsg struct {
 	queueName string
 	data      []byte
+	replyCh   chan error
 }
 
 type queueReg struct {
@@ -60,11 +86,15 @@ type queueReg struct {
 // PeerStore ...
 type PeerStore struct {
 	peers []*peerInfo
+
+	// removed peers (name to amount of entries when removed), connects
+	// from those are rejected until peer is added again
+	removed map[string]int
 	sync.RWMutex
 }
 
 func newPeerStore() *PeerStore {
-	return &PeerStore{peers: []*peerInfo{}}
+	return &PeerStore{peers: []*peerInfo{}, removed: map[string]int{}}
 }
 
 func (ps *PeerStore) getPrint() string {
@@ -79,15 +109,33 @@ func (ps *PeerStore) getPrint() string {
 }
 
 func (ps *PeerStore) getPeerByName(name string) (*msg.Connection, error) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	// there can be several entries for same peer (if both have
+	// connected to each other), any entry which is up is used
+	err := fmt.Errorf("%w (%s)", ErrUnknownNode, name)
 	for _, v := range ps.peers {
 		if v.name == name {
 			if v.state == stateUp {
 				return v.conn, nil
 			}
-			return nil, fmt.Errorf("Invalid connection state (%v)", v.state)
+			err = fmt.Errorf("%w (%s is %v)", ErrPeerDown, name, v.state)
+		}
+	}
+	return nil, err
+}
+
+// isUp returns true if some entry of peer is up, there can be several
+// entries for same peer if both have connected to each other (caller
+// holds lock)
+func (ps *PeerStore) isUp(name string) bool {
+	for _, v := range ps.peers {
+		if v.name == name && v.state == stateUp {
+			return true
 		}
 	}
-	return nil, fmt.Errorf("Peer (%s) not found", name)
+	return false
 }
 
 func (ps *PeerStore) updClosing() []*msg.Connection {
@@ -118,46 +166,76 @@ func (ps *PeerStore) addPeer(addr string, conn *msg.Connection) int {
 	return len(ps.peers) - 1
 }
 
-func (ps *PeerStore) updLeaving(name string) (*msg.Connection, bool) {
+// updLeaving marks all entries of peer closed, returns their connections
+func (ps *PeerStore) updLeaving(name string) ([]*msg.Connection, bool, bool) {
 	ps.Lock()
 	defer ps.Unlock()
 
+	conns := []*msg.Connection{}
+	found, wasUp := false, false
 	for _, v := range ps.peers {
 		if v.name == name {
+			found = true
+			wasUp = wasUp || v.state == stateUp
 			v.state = stateClosed
-			return v.conn, true
+			if v.conn != nil {
+				conns = append(conns, v.conn)
+			}
 		}
 	}
-	return nil, false
+	return conns, found, wasUp
 }
 
-func (ps *PeerStore) updConn2(conID int, name, addr string) (*msg.Connection, bool) {
+func (ps *PeerStore) updConn2(conID int, name, addr string, addrs []string) (*msg.Connection, bool, bool) {
 	ps.Lock()
 	defer ps.Unlock()
 
 	if conID+1 > len(ps.peers) {
-		return nil, false
+		return nil, false, false
 	}
 	if (ps.peers[conID].name != "") && (ps.peers[conID].name != name) {
-		return nil, false
+		return nil, false, false
+	}
+	if removedAt, removed := ps.removed[name]; removed {
+		// peer added again (by address) is not removed anymore, entries
+		// which existed already or are discovered are not connected
+		if conID < removedAt || ps.peers[conID].discovered {
+			ps.peers[conID].addr = ""
+			ps.peers[conID].state = stateClosed
+			return ps.peers[conID].conn, false, false
+		}
+		delete(ps.removed, name)
+	}
+	becameUp := !ps.isUp(name)
+	if ps.peers[conID].state != stateUp {
+		ps.peers[conID].since = time.Now()
 	}
 	ps.peers[conID].name = name
 	ps.peers[conID].recAddr = addr
+	ps.peers[conID].addrs = addrs
 	ps.peers[conID].state = stateUp
-	return ps.peers[conID].conn, true
+	return ps.peers[conID].conn, true, becameUp
 }
 
-func (ps *PeerStore) updConn(conn *msg.Connection, name, addr string) (*msg.Connection, bool) {
+func (ps *PeerStore) updConn(conn *msg.Connection, name, addr string, addrs []string) (*msg.Connection, bool, bool) {
 	ps.Lock()
 	defer ps.Unlock()
 
+	if _, removed := ps.removed[name]; removed {
+		return nil, false, false
+	}
 	for i := range ps.peers {
 		if ps.peers[i].name == name {
+			becameUp := !ps.isUp(name)
+			if ps.peers[i].state != stateUp {
+				ps.peers[i].since = time.Now()
+			}
 			ps.peers[i].name = name
 			ps.peers[i].conn = conn
 			ps.peers[i].recAddr = addr
+			ps.peers[i].addrs = addrs
 			ps.peers[i].state = stateUp
-			return ps.peers[i].conn, true
+			return ps.peers[i].conn, true, becameUp
 		}
 	}
 	peer := &peerInfo{
@@ -165,10 +243,12 @@ func (ps *PeerStore) updConn(conn *msg.Connection, name, addr string) (*msg.Conn
 		conn:    conn,
 		name:    name,
 		recAddr: addr,
+		addrs:   addrs,
 		state:   stateUp,
+		since:   time.Now(),
 	}
 	ps.peers = append(ps.peers, peer)
-	return conn, true
+	return conn, true, true
 }
 
 type msgFormat struct {
@@ -176,16 +256,25 @@ type msgFormat struct {
 	TargetQName string          `json:"qname"`
 	Data        json.RawMessage `json:"data"`
 	PayloadData []byte          `json:"pdata"`
+
+	// target broker and hops left for forwarded payload,
+	// sender of acknowledged payload waits reply at most AckTimeout
+	Target     string        `json:"target,omitempty"`
+	Hops       int           `json:"hops,omitempty"`
+	AckTimeout time.Duration `json:"ack-timeout,omitempty"`
 }
 
+// connect and connect-ack contain listening addresses of sender
 type connectMsg struct {
-	Name string `json:"name"`
-	ID   int    `json:"id"`
+	Name  string   `json:"name"`
+	ID    int      `json:"id"`
+	Addrs []string `json:"addrs,omitempty"`
 }
 
 type connectAckMsg struct {
-	Name string `json:"name"`
-	ID   int    `json:"id"`
+	Name  string   `json:"name"`
+	ID    int      `json:"id"`
+	Addrs []string `json:"addrs,omitempty"`
 }
 
 type leaveMsg struct {
@@ -200,8 +289,7 @@ func (broker *Broker) RegisterQueue(qname string, q *queue.Queue) error {
 		q:       q,
 		replyCh: replyCh,
 	}
-	broker.RegCh <- req
-	return <-replyCh
+	return broker.register(req)
 }
 
 // UnRegisterQueue ...
@@ -212,38 +300,107 @@ func (broker *Broker) UnRegisterQueue(qname string) error {
 		replyCh: replyCh,
 		remove:  true,
 	}
-	broker.RegCh <- req
-	return <-replyCh
+	return broker.register(req)
 }
 
-// Close ...
-func (broker *Broker) Close() {
-	conns := broker.Peers.updClosing()
+func (broker *Broker) register(req queueReg) error {
+	select {
+	case broker.RegCh <- req:
+		return <-req.replyCh
+	case <-broker.stop:
+		return ErrBrokerClosed
+	}
+}
 
-	for _, conn := range conns {
-		leave := &leaveMsg{
-			Name: broker.OwnName,
-		}
-		leaveData, err := json.Marshal(leave)
-		if err != nil {
-			debugPrint("Marshal failed: ", err)
-			continue
-		}
-		leaveMsg := &msgFormat{
-			MsgName: "leave",
-			Data:    leaveData,
-		}
-		leaveMsgData, err := json.Marshal(leaveMsg)
-		if err != nil {
-			debugPrint("Marshal failed: ", err)
-			continue
+// Close sends leave message to peers, stops broker goroutines and
+// closes messaging server (and all connections), queues are unregistered
+// (and closed if 'close-queues' option is set). Close waits for broker
+// goroutines so it must not be called from WatchPeers function.
+func (broker *Broker) Close() {
+	broker.closeOnce.Do(func() {
+		conns := broker.Peers.updClosing()
+		for _, conn := range conns {
+			broker.sendLeave(conn)
 		}
-		err = conn.Send(string(leaveMsgData))
-		if err != nil {
-			debugPrint("Leave send failed: ", err)
-			continue
+
+		close(broker.stop)
+		broker.Server.Close()
+		broker.wg.Wait()
+		broker.log(msg.LevelInfo, "Broker closed")
+	})
+}
+
+func (broker *Broker) isClosed() bool {
+	select {
+	case <-broker.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// start starts broker goroutine, Close waits until it has returned
+func (broker *Broker) start(f func()) {
+	broker.wg.Add(1)
+	go func() {
+		defer broker.wg.Done()
+		f()
+	}()
+}
+
+func (broker *Broker) sendLeave(conn *msg.Connection) {
+	err := sendBrokerMsg(conn, "leave", &leaveMsg{Name: broker.OwnName})
+	if err != nil {
+		broker.log(msg.LevelWarn, "Leave send failed", "error", err)
+	}
+}
+
+// Addrs returns addresses which broker is listening (advertised to peers),
+// unspecified host (like with own-addr ':0') is replaced with host of own-addr
+// if it has one (otherwise peers replace it with host they see broker from)
+func (broker *Broker) Addrs() []string {
+	return resolveAddrs(broker.Server.Addrs(), broker.OwnAddr)
+}
+
+// resolveAddrs replaces unspecified host (empty, [::] or 0.0.0.0) in
+// addresses with host of seenFrom, addresses without host and port
+// (like mem:// addresses) are kept as they are
+func resolveAddrs(addrs []string, seenFrom string) []string {
+	_, seenHost, _, ok := splitAddr(seenFrom)
+	if !ok || unspecifiedHost(seenHost) {
+		return addrs
+	}
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		scheme, host, port, ok := splitAddr(addr)
+		if ok && unspecifiedHost(host) {
+			addr = scheme + net.JoinHostPort(seenHost, port)
 		}
+		result = append(result, addr)
+	}
+	return result
+}
+
+// splitAddr splits address to scheme prefix (like "udp://"), host and port
+func splitAddr(addr string) (scheme, host, port string, ok bool) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, addr = addr[:i+3], addr[i+3:]
 	}
+	host, port, err := net.SplitHostPort(addr)
+	return scheme, host, port, err == nil
+}
+
+func unspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// log logs record with logger of messaging server
+func (broker *Broker) log(level msg.LogLevel, message string, fields ...interface{}) {
+	broker.Server.Log(level, message, append([]interface{}{"broker", broker.OwnName}, fields...)...)
 }
 
 func (broker *Broker) manager() {
@@ -251,6 +408,14 @@ func (broker *Broker) manager() {
 
 	for {
 		select {
+		case <-broker.stop:
+			for _, q := range queues {
+				if broker.closeQueues {
+					q.Close()
+				}
+			}
+			return
+
 		// register/unregister queue with name
 		case reg := <-broker.RegCh:
 			if reg.remove {
@@ -260,72 +425,129 @@ func (broker *Broker) manager() {
 			}
 			reg.replyCh <- nil
 
-		// payload message from receiver
+		// payload message from receiver (or local sender)
 		case message := <-broker.PayloadCh:
-			if message.queueName == "" {
-				debugPrint("Empty queue name")
-				continue
-			}
-			q, found := queues[message.queueName]
-			if !found {
-				continue
-			}
-			var qitem interface{}
-			if broker.Decoder != nil {
-				qitem = broker.Decoder(message.data)
-			} else {
-				qitem = message.data
-			}
-			isFull := q.PutNoWait(qitem)
-			if isFull {
-				debugPrint("Queue full, dropping")
+			err := broker.deliver(queues, message)
+			if message.replyCh != nil {
+				message.replyCh <- err
 			}
 		}
 	}
 }
 
+// deliver puts payload to local queue
+func (broker *Broker) deliver(queues map[string]*queue.Queue, message payloadMsg) error {
+	if message.queueName == "" {
+		broker.log(msg.LevelWarn, "Empty queue name")
+		return fmt.Errorf("%w (empty name)", ErrQueueNotFound)
+	}
+	q, found := queues[message.queueName]
+	if !found {
+		return fmt.Errorf("%w (%s)", ErrQueueNotFound, message.queueName)
+	}
+	var qitem interface{}
+	if broker.Decoder != nil {
+		qitem = broker.Decoder(message.data)
+	} else {
+		qitem = message.data
+	}
+	isFull := q.PutNoWait(qitem)
+	if isFull {
+		broker.log(msg.LevelWarn, "Queue full, dropping", "queue", message.queueName)
+		return fmt.Errorf("%w (%s)", ErrQueueFull, message.queueName)
+	}
+	return nil
+}
+
 // SendMsg ...
 func (broker *Broker) SendMsg(nodeName, queueName string, data []byte) error {
+	if broker.isClosed() {
+		return ErrBrokerClosed
+	}
 	if nodeName == broker.OwnName {
 		// its local queue
-		broker.PayloadCh <- payloadMsg{queueName: queueName, data: data}
-		return nil
+		replyCh := make(chan error, 1)
+		select {
+		case broker.PayloadCh <- payloadMsg{queueName: queueName, data: data, replyCh: replyCh}:
+			return <-replyCh
+		case <-broker.stop:
+			return ErrBrokerClosed
+		}
 	}
 
-	// ok, lets send it to some peer node
-	con, err := broker.Peers.getPeerByName(nodeName)
-	payloadmsg := &msgFormat{
+	// ok, lets send it to some peer node (directly or via route)
+	con, err := broker.nextHop(nodeName)
+	if err != nil {
+		return err
+	}
+	payloadmsg := msgFormat{
 		MsgName:     "payload",
 		TargetQName: queueName,
 		PayloadData: data,
+		Target:      nodeName,
+		Hops:        broker.maxHops,
 	}
-	payloadMsgData, err := json.Marshal(payloadmsg)
+	err = broker.sendPayload(con, payloadmsg)
 	if err != nil {
-		errval := fmt.Errorf("Marshal failed: %v", err)
-		debugPrint(errval)
-		return errval
+		broker.log(msg.LevelDebug, "Message send failed", "peer", nodeName, "queue", queueName, "error", err)
+		return err
+	}
+	return nil
+}
+
+// Broadcast sends message to queue in all peers which are up and
+// to local queue, returns result for each node (nil if sent)
+func (broker *Broker) Broadcast(queueName string, data []byte) map[string]error {
+	result := map[string]error{}
+	if broker.isClosed() {
+		result[broker.OwnName] = ErrBrokerClosed
+		return result
+	}
+	for name, con := range broker.Peers.getUpPeers() {
+		payloadmsg := msgFormat{
+			MsgName:     "payload",
+			TargetQName: queueName,
+			PayloadData: data,
+			Target:      name,
+			Hops:        broker.maxHops,
+		}
+		err := broker.sendPayload(con, payloadmsg)
+		if err != nil {
+			broker.log(msg.LevelDebug, "Broadcast send failed", "peer", name, "queue", queueName, "error", err)
+		}
+		result[name] = err
+	}
+	result[broker.OwnName] = broker.SendMsg(broker.OwnName, queueName, data)
+	return result
+}
+
+func (broker *Broker) sendPayload(con *msg.Connection, payloadmsg msgFormat) error {
+	payloadMsgData, err := json.Marshal(&payloadmsg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEncodeFailed, err)
 	}
 	err = con.Send(string(payloadMsgData))
 	if err != nil {
-		errval := fmt.Errorf("Message send failed: %v", err)
-		debugPrint(errval)
-		return errval
+		return fmt.Errorf("Message send failed: %w", err)
 	}
 	return nil
 }
 
 func (broker *Broker) receiver() {
 	for {
-		msg, err := broker.Server.Receive()
+		received, err := broker.Server.Receive()
+		if err == msg.ErrServerClosed {
+			return
+		}
 		if err != nil {
-			debugPrint("receiver error: ", err)
+			broker.log(msg.LevelError, "Receive failed", "error", err)
 			continue
 		}
-		//fmt.Println(fmt.Sprintf("MSG: %#v", msg))
+		//fmt.Println(fmt.Sprintf("MSG: %#v", received))
 
 		var msgform msgFormat
-		if err := json.Unmarshal([]byte(msg.Data), &msgform); err != nil {
-			debugPrint("decode error: ", err)
+		if err := json.Unmarshal([]byte(received.Data), &msgform); err != nil {
+			broker.log(msg.LevelWarn, "Message decode failed", "addr", received.FromAddr, "error", err)
 			continue
 		}
 
@@ -337,26 +559,35 @@ func (broker *Broker) receiver() {
 
 			var conMsg connectMsg
 			if err := json.Unmarshal([]byte(msgform.Data), &conMsg); err != nil {
-				debugPrint("Connect msg decode failed: ", err)
+				broker.log(msg.LevelWarn, "Connect msg decode failed", "addr", received.FromAddr, "error", err)
 				continue
 			}
 
-			conn, err := broker.Server.OpenConnection(msg.FromAddr)
-			con, found := broker.Peers.updConn(conn, conMsg.Name, msg.FromAddr)
+			conn, err := broker.openConnection(received.FromAddr)
+			if err != nil {
+				broker.log(msg.LevelWarn, "Connecting failed", "peer", conMsg.Name, "addr", received.FromAddr, "error", err)
+				continue
+			}
+			con, found, becameUp := broker.Peers.updConn(conn, conMsg.Name, received.FromAddr, resolveAddrs(conMsg.Addrs, received.FromAddr))
+			if becameUp {
+				broker.peerEvent(PeerUp, conMsg.Name, received.FromAddr, "connected")
+			}
 			if !found {
-				debugPrint(fmt.Sprintf("Connection not found (%d)", conMsg.ID))
-				//fmt.Println("PEERS: ", broker.Peers.getPrint())
+				// peer has been removed
+				broker.log(msg.LevelDebug, "Connect rejected", "peer", conMsg.Name, "addr", received.FromAddr)
+				conn.Close()
 				continue
 			}
 			//fmt.Println("PEERS: ", broker.Peers.getPrint())
 
 			connectAckData := &connectAckMsg{
-				Name: broker.OwnName,
-				ID:   conMsg.ID,
+				Name:  broker.OwnName,
+				ID:    conMsg.ID,
+				Addrs: broker.Addrs(),
 			}
 			conAckData, err := json.Marshal(connectAckData)
 			if err != nil {
-				debugPrint("Marshal failed: ", err)
+				broker.log(msg.LevelError, "Marshal failed", "error", err)
 				continue
 			}
 			connectAckmsg := &msgFormat{
@@ -365,12 +596,12 @@ func (broker *Broker) receiver() {
 			}
 			conAckMsgData, err := json.Marshal(connectAckmsg)
 			if err != nil {
-				debugPrint("Marshal failed: ", err)
+				broker.log(msg.LevelError, "Marshal failed", "error", err)
 				continue
 			}
 			err = con.Send(string(conAckMsgData))
 			if err != nil {
-				debugPrint("Ack send failed: ", err)
+				broker.log(msg.LevelWarn, "Ack send failed", "peer", conMsg.Name, "addr", received.FromAddr, "error", err)
 				continue
 			}
 
@@ -380,12 +611,18 @@ func (broker *Broker) receiver() {
 
 			var conAckMsg connectAckMsg
 			if err := json.Unmarshal(msgform.Data, &conAckMsg); err != nil {
-				debugPrint("Connect-ack msg decode failed: ", err)
+				broker.log(msg.LevelWarn, "Connect-ack msg decode failed", "addr", received.FromAddr, "error", err)
 				continue
 			}
-			_, found := broker.Peers.updConn2(conAckMsg.ID, conAckMsg.Name, msg.FromAddr)
+			con, found, becameUp := broker.Peers.updConn2(conAckMsg.ID, conAckMsg.Name, received.FromAddr, resolveAddrs(conAckMsg.Addrs, received.FromAddr))
+			if becameUp {
+				broker.peerEvent(PeerUp, conAckMsg.Name, received.FromAddr, "connected")
+			}
 			if !found {
-				debugPrint(fmt.Sprintf("Connection not found (%d)(%s)", conAckMsg.ID, conAckMsg.Name))
+				if con != nil {
+					con.Close()
+				}
+				broker.log(msg.LevelDebug, "Connection not found", "peer", conAckMsg.Name, "addr", received.FromAddr, "id", conAckMsg.ID)
 				//fmt.Println("PEERS: ", broker.Peers.getPrint())
 				continue
 			}
@@ -395,19 +632,64 @@ func (broker *Broker) receiver() {
 		case "leave":
 			var leaveMsg leaveMsg
 			if err := json.Unmarshal(msgform.Data, &leaveMsg); err != nil {
-				debugPrint("Leave msg decode failed: ", err)
+				broker.log(msg.LevelWarn, "Leave msg decode failed", "addr", received.FromAddr, "error", err)
 				continue
 			}
 			//fmt.Println("LEAVE RECEIVED: ", leaveMsg.Name)
-			con, found := broker.Peers.updLeaving(leaveMsg.Name)
+			conns, found, wasUp := broker.Peers.updLeaving(leaveMsg.Name)
 			if !found {
-				debugPrint("Connection not found: ", leaveMsg.Name)
+				broker.log(msg.LevelDebug, "Connection not found", "peer", leaveMsg.Name, "addr", received.FromAddr)
+				continue
+			}
+			if wasUp {
+				broker.peerEvent(PeerDown, leaveMsg.Name, received.FromAddr, "left")
+			}
+			if broker.members != nil {
+				if m, changed := broker.members.setStatus(leaveMsg.Name, MemberDead); changed {
+					broker.memberDead(m)
+				}
+			}
+			for _, con := range conns {
+				con.Close()
 			}
-			con.Close()
 
 		// payload message
 		case "payload":
-			broker.PayloadCh <- payloadMsg{queueName: msgform.TargetQName, data: msgform.PayloadData}
+			broker.Peers.countReceived(received.FromAddr, len(msgform.PayloadData))
+			if msgform.Target != "" && msgform.Target != broker.OwnName {
+				if received.CallID != "" {
+					broker.start(func() { broker.forwardAcked(received, msgform) })
+					continue
+				}
+				broker.forward(msgform)
+				continue
+			}
+			// acknowledged payload is replied with result of delivery
+			var replyCh chan error
+			if received.CallID != "" {
+				replyCh = make(chan error, 1)
+			}
+			select {
+			case broker.PayloadCh <- payloadMsg{queueName: msgform.TargetQName, data: msgform.PayloadData, replyCh: replyCh}:
+			case <-broker.stop:
+				return
+			}
+			if replyCh != nil {
+				broker.sendAck(received, <-replyCh)
+			}
+
+		// route advertisement
+		case "routes":
+			var advert routesMsg
+			if err := json.Unmarshal(msgform.Data, &advert); err != nil {
+				broker.log(msg.LevelWarn, "Routes msg decode failed", "addr", received.FromAddr, "error", err)
+				continue
+			}
+			broker.handleRoutes(advert)
+
+		// gossip membership messages
+		case "gossip", "probe", "probe-req", "probe-ack":
+			broker.handleGossip(received, msgform)
 		}
 	}
 }
@@ -442,8 +724,41 @@ func CreateBrokerV2(options map[string]interface{}, decoder func([]byte) interfa
 		return nil, fmt.Errorf("Invalid format for peers")
 	}
 
+	reconnectInterval := defaultReconnectInterval
+	if v, found := options["reconnect-interval"]; found {
+		interval, ok := v.(int)
+		if !ok || interval <= 0 {
+			return nil, fmt.Errorf("Invalid format for reconnect-interval")
+		}
+		reconnectInterval = time.Duration(interval)
+	}
+
+	closeQueues := false
+	if v, found := options["close-queues"]; found {
+		if closeQueues, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("Invalid format for close-queues")
+		}
+	}
+
+	gossip, err := gossipOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	routing, routingEnabled, err := routingOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	ack, err := ackOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
 	// create own msg server
-	server, err := msg.CreateServer(msg.Options{Addr: ownAddr})
+	serverOptions := msg.Options{Addr: ownAddr}
+	if err := serverOptions.SetFromMap(options); err != nil {
+		return nil, err
+	}
+	server, err := msg.CreateServer(serverOptions)
 	if err != nil {
 		return nil, fmt.Errorf("CreateServer failed: %v", err)
 	}
@@ -456,43 +771,36 @@ func CreateBrokerV2(options map[string]interface{}, decoder func([]byte) interfa
 		RegCh:     make(chan queueReg),
 		PayloadCh: make(chan payloadMsg),
 		Decoder:   decoder,
+
+		reconnectInterval: reconnectInterval,
+		closeQueues:       closeQueues,
+		routeTrigger:      make(chan struct{}, 1),
+		memberTrigger:     make(chan struct{}, 1),
+		maxHops:           routing.maxHops,
+		ack:               ack,
+		peerEvents:        make(chan PeerEvent, 10),
+		stop:              make(chan struct{}),
+	}
+	if gossip != nil {
+		broker.members = newMembership(*gossip, Member{Name: ownname, Addrs: broker.Addrs(), Status: MemberAlive})
 	}
-	go broker.receiver()
-	go broker.manager()
+	if routingEnabled {
+		broker.routes = newRouteTable(routing.maxHops)
+	}
+	broker.start(broker.receiver)
+	broker.start(broker.manager)
 
-	// connect to peers
+	// connect to peers, unreachable ones are retried by supervisor
 	for _, addr := range peers {
-		con, err := server.OpenConnection(addr)
-		if err != nil {
-			debugPrint("Connecting failed: ", err)
-			continue
-		}
-
-		id := broker.Peers.addPeer(addr, con)
-
-		connectData := &connectMsg{
-			Name: ownname,
-			ID:   id,
-		}
-		conData, err := json.Marshal(connectData)
-		if err != nil {
-			debugPrint("Marshal failed: ", err)
-			continue
-		}
-		connectmsg := &msgFormat{
-			MsgName: "connect",
-			Data:    conData,
-		}
-		conMsgData, err := json.Marshal(connectmsg)
-		if err != nil {
-			debugPrint("Marshal failed: ", err)
-			continue
-		}
-		err = con.Send(string(conMsgData))
-		if err != nil {
-			debugPrint("Initial send failed: ", err)
-			continue
-		}
+		id := broker.Peers.addPeer(addr, nil)
+		broker.connectPeer(id, addr, msg.LevelWarn)
+	}
+	broker.start(broker.supervisor)
+	if gossip != nil {
+		broker.start(broker.gossiper)
+	}
+	if routingEnabled {
+		broker.start(func() { broker.router(routing.interval) })
 	}
 
 	return broker, nil
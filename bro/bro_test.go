@@ -0,0 +1,755 @@
+package bro
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/internal/testutil"
+	"github.com/anssihalmeaho/mzq/msg"
+	"github.com/anssihalmeaho/mzq/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+// options for testing gossip and routing with short intervals
+var (
+	gossipTestOptions = map[string]interface{}{
+		"gossip":          true,
+		"gossip-interval": int(20 * time.Millisecond),
+	}
+	routingTestOptions = map[string]interface{}{
+		"routing":        true,
+		"route-interval": int(20 * time.Millisecond),
+	}
+)
+
+// newTestBroker creates broker listening mem://<name> which is closed
+// when test ends, extra options (may be nil) override default ones
+func newTestBroker(t *testing.T, name string, extra map[string]interface{}, peerAddrs ...string) *Broker {
+	options := map[string]interface{}{
+		"own-name": name,
+		"own-addr": "mem://" + name,
+		"addrs":    peerAddrs,
+	}
+	for k, v := range extra {
+		options[k] = v
+	}
+	broker, err := CreateBroker(options)
+	if err != nil {
+		t.Fatalf("CreateBroker failed: %v", err)
+	}
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func waitPeerUp(t *testing.T, broker *Broker, name string) {
+	t.Helper()
+	testutil.WaitFor(t, func() bool {
+		_, err := broker.Peers.getPeerByName(name)
+		return err == nil
+	}, "peer %s not up in %s", name, broker.OwnName)
+}
+
+func TestSendBetweenBrokers(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newTestBroker(t, "test-send-b", nil)
+	a := newTestBroker(t, "test-send-a", nil, "mem://test-send-b")
+	waitPeerUp(t, a, "test-send-b")
+	waitPeerUp(t, b, "test-send-a")
+
+	qa := queue.NewQueue(5)
+	qb := queue.NewQueue(5)
+	assert.Nil(a.RegisterQueue("q", qa))
+	assert.Nil(b.RegisterQueue("q", qb))
+
+	assert.Nil(a.SendMsg("test-send-b", "q", []byte("to b")))
+	assert.Equal([]byte("to b"), qb.Get())
+
+	assert.Nil(b.SendMsg("test-send-a", "q", []byte("to a")))
+	assert.Equal([]byte("to a"), qa.Get())
+
+	assert.Nil(a.SendMsg("test-send-a", "q", []byte("local")))
+	assert.Equal([]byte("local"), qa.Get())
+}
+
+func TestAdvertisedAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "adv-a", map[string]interface{}{
+		"listen-addrs": []string{"127.0.0.1:0"},
+	})
+	assert.Equal(2, len(brokerA.Addrs()))
+	brokerB := newTestBroker(t, "adv-b", nil, "mem://adv-a")
+	waitPeerUp(t, brokerA, "adv-b")
+	waitPeerUp(t, brokerB, "adv-a")
+
+	// both peers know listening addresses of other
+	assert.Equal(brokerA.Addrs(), peerAddrs(brokerB, "adv-a"))
+	assert.Equal(brokerB.Addrs(), peerAddrs(brokerA, "adv-b"))
+}
+
+func peerAddrs(broker *Broker, name string) []string {
+	broker.Peers.RLock()
+	defer broker.Peers.RUnlock()
+
+	for _, peer := range broker.Peers.peers {
+		if peer.name == name {
+			return peer.addrs
+		}
+	}
+	return nil
+}
+
+func waitPeerEvent(t *testing.T, broker *Broker, eventType PeerEventType, name string) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-broker.PeerEvents():
+			if event.Type == eventType && event.Name == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%v of %s not received in %s", eventType, name, broker.OwnName)
+		}
+	}
+}
+
+func TestPeerSupervision(t *testing.T) {
+	assert := assert.New(t)
+
+	// peer is not up when broker is created
+	brokerA := newTestBroker(t, "sup-a", map[string]interface{}{
+		"reconnect-interval": int(10 * time.Millisecond),
+	}, "mem://sup-b")
+	brokerB := newTestBroker(t, "sup-b", nil)
+	waitPeerEvent(t, brokerA, PeerUp, "sup-b")
+	waitPeerEvent(t, brokerB, PeerUp, "sup-a")
+
+	// connection is lost and re-established
+	con, err := brokerA.Peers.getPeerByName("sup-b")
+	assert.Nil(err)
+	con.Close()
+	waitPeerEvent(t, brokerA, PeerDown, "sup-b")
+	waitPeerEvent(t, brokerA, PeerUp, "sup-b")
+	waitPeerEvent(t, brokerB, PeerUp, "sup-a")
+
+	q := queue.NewQueue(10)
+	assert.Nil(brokerB.RegisterQueue("sup-q", q))
+	assert.Nil(brokerA.SendMsg("sup-b", "sup-q", []byte("after reconnect")))
+	assert.Equal([]byte("after reconnect"), q.Get())
+}
+
+func TestDialCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	transport := testutil.NewBlockTransport(2)
+	msg.RegisterTransport("block", transport)
+	brokerA := newTestBroker(t, "dial-a", map[string]interface{}{
+		"dial-timeout":       int(10 * time.Second),
+		"reconnect-interval": int(10 * time.Millisecond),
+	})
+
+	// both AddPeer and supervisor are dialing unreachable peer
+	added := make(chan error, 1)
+	go func() {
+		added <- brokerA.AddPeer("block://dial-x")
+	}()
+	<-transport.Dialing
+	<-transport.Dialing
+
+	// closing broker cancels dialing
+	start := time.Now()
+	brokerA.Close()
+	assert.True(time.Since(start) < time.Second)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("dialing not cancelled")
+	}
+}
+
+// waitAliveMembers waits until broker knows given amount of members
+// and all of those are alive
+func waitAliveMembers(t *testing.T, broker *Broker, count int) {
+	t.Helper()
+	testutil.WaitFor(t, func() bool {
+		alive := 0
+		members := broker.Members()
+		for _, m := range members {
+			if m.Status == MemberAlive {
+				alive++
+			}
+		}
+		return alive == count && len(members) == count
+	}, "%d members not alive in %s", count, broker.OwnName)
+}
+
+func TestGossipDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	// only seed address is given
+	brokerA := newTestBroker(t, "gossip-a", gossipTestOptions)
+	brokerB := newTestBroker(t, "gossip-b", gossipTestOptions, "mem://gossip-a")
+	brokerC := newTestBroker(t, "gossip-c", gossipTestOptions, "mem://gossip-a")
+	waitPeerUp(t, brokerB, "gossip-c")
+	waitPeerUp(t, brokerC, "gossip-b")
+
+	for _, broker := range []*Broker{brokerA, brokerB, brokerC} {
+		waitAliveMembers(t, broker, 3)
+	}
+
+	q := queue.NewQueue(10)
+	assert.Nil(brokerC.RegisterQueue("gossip-q", q))
+	assert.Nil(brokerB.SendMsg("gossip-c", "gossip-q", []byte("discovered")))
+	assert.Equal([]byte("discovered"), q.Get())
+}
+
+func TestUnspecifiedAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	options := map[string]interface{}{"own-addr": ":0"}
+	for k, v := range gossipTestOptions {
+		options[k] = v
+	}
+	brokerA := newTestBroker(t, "unspec-a", options)
+	seed := brokerA.Addrs()[0]
+	brokerB := newTestBroker(t, "unspec-b", options, seed)
+	brokerC := newTestBroker(t, "unspec-c", options, seed)
+
+	// B and C connect to each other with addresses gossiped by A
+	waitPeerUp(t, brokerB, "unspec-c")
+	waitPeerUp(t, brokerC, "unspec-b")
+	for _, broker := range []*Broker{brokerA, brokerB, brokerC} {
+		waitAliveMembers(t, broker, 3)
+	}
+
+	specified := func(addrs []string) bool {
+		for _, addr := range addrs {
+			if _, host, _, ok := splitAddr(addr); !ok || unspecifiedHost(host) {
+				return false
+			}
+		}
+		return len(addrs) > 0
+	}
+	for _, broker := range []*Broker{brokerA, brokerB, brokerC} {
+		for _, m := range broker.Members() {
+			if m.Name != broker.OwnName {
+				assert.True(specified(m.Addrs), "%s: %s %v", broker.OwnName, m.Name, m.Addrs)
+			}
+		}
+		for _, peer := range broker.PeerInfo() {
+			if peer.State == "up" {
+				assert.True(specified(peer.Addrs), "%s: %s %v", broker.OwnName, peer.Name, peer.Addrs)
+			}
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	assert := assert.New(t)
+
+	config := gossipConfig{interval: time.Millisecond, probeTimeout: time.Millisecond, suspectTimeout: 10 * time.Millisecond}
+	ms := newMembership(config, Member{Name: "a", Status: MemberAlive})
+	dead := ms.merge([]Member{
+		{Name: "b", Status: MemberAlive},
+		{Name: "c", Status: MemberAlive, Incarnation: 2},
+		{Name: "d", Status: MemberDead},
+	})
+	assert.Equal(0, len(dead))
+	assert.Equal(3, len(ms.list()))
+
+	// old information is ignored
+	ms.merge([]Member{{Name: "c", Status: MemberSuspect, Incarnation: 1}})
+	assert.Equal(MemberAlive, ms.list()[2].Status)
+
+	// suspicion of self is refuted with new incarnation
+	ms.merge([]Member{{Name: "a", Status: MemberSuspect}})
+	assert.Equal(Member{Name: "a", Status: MemberAlive, Incarnation: 1}, ms.list()[0])
+
+	// suspect is declared dead after suspect timeout
+	_, changed := ms.setStatus("b", MemberSuspect)
+	assert.True(changed)
+	assert.Equal(0, len(ms.expire()))
+	time.Sleep(20 * time.Millisecond)
+	dead = ms.expire()
+	assert.Equal(1, len(dead))
+	assert.Equal("b", dead[0].Name)
+
+	// alive with newer incarnation overrides
+	ms.merge([]Member{{Name: "b", Status: MemberAlive, Incarnation: 1}})
+	assert.Equal(MemberAlive, ms.list()[1].Status)
+}
+
+func waitRoute(t *testing.T, broker *Broker, name string) Route {
+	t.Helper()
+	var route Route
+	testutil.WaitFor(t, func() bool {
+		for _, r := range broker.Routes() {
+			if r.Name == name {
+				route = r
+				return true
+			}
+		}
+		return false
+	}, "no route to %s in %s", name, broker.OwnName)
+	return route
+}
+
+func TestCloseWhileProbing(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newTestBroker(t, "probing-a", map[string]interface{}{
+		"gossip":          true,
+		"gossip-interval": int(10 * time.Second),
+	})
+
+	// member which is not connected doesn't answer to probe
+	broker.members.merge([]Member{{Name: "probing-x", Status: MemberAlive}})
+	broker.gossipRound()
+
+	start := time.Now()
+	broker.Close()
+	assert.True(time.Since(start) < time.Second, "Close took %v", time.Since(start))
+
+	// probe has finished when Close returns
+	broker.members.lock.Lock()
+	assert.Equal(0, len(broker.members.acks))
+	broker.members.lock.Unlock()
+	for _, m := range broker.Members() {
+		assert.Equal(MemberAlive, m.Status, m.Name)
+	}
+}
+
+func TestMultiHopRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	// chain: route-a - route-b - route-c - route-d
+	brokerA := newTestBroker(t, "route-a", routingTestOptions)
+	brokerB := newTestBroker(t, "route-b", routingTestOptions, "mem://route-a")
+	brokerC := newTestBroker(t, "route-c", routingTestOptions, "mem://route-b")
+	brokerD := newTestBroker(t, "route-d", routingTestOptions, "mem://route-c")
+
+	assert.Equal(Route{Name: "route-d", Via: "route-b", Hops: 3}, waitRoute(t, brokerA, "route-d"))
+	assert.Equal(Route{Name: "route-a", Via: "route-c", Hops: 3}, waitRoute(t, brokerD, "route-a"))
+	assert.Equal(Route{Name: "route-c", Via: "route-b", Hops: 2}, waitRoute(t, brokerA, "route-c"))
+
+	q := queue.NewQueue(10)
+	assert.Nil(brokerD.RegisterQueue("route-q", q))
+	assert.Nil(brokerA.SendMsg("route-d", "route-q", []byte("forwarded")))
+	assert.Equal([]byte("forwarded"), q.Get())
+	assert.Nil(brokerA.SendMsgAcked("route-d", "route-q", []byte("acked")))
+	assert.Equal([]byte("acked"), q.Get())
+	assert.True(errors.Is(brokerA.SendMsgAcked("route-d", "no-such-queue", []byte("acked")), ErrQueueNotFound))
+
+	qA := queue.NewQueue(10)
+	assert.Nil(brokerA.RegisterQueue("route-q", qA))
+	assert.Nil(brokerD.SendMsg("route-a", "route-q", []byte("back")))
+	assert.Equal([]byte("back"), qA.Get())
+
+	// no route to unknown broker
+	assert.NotNil(brokerA.SendMsg("route-x", "route-q", []byte("lost")))
+
+	// routes through closed broker are removed
+	brokerC.Close()
+	waitPeerEvent(t, brokerB, PeerDown, "route-c")
+	testutil.WaitFor(t, func() bool {
+		return len(brokerA.Routes()) == 0
+	}, "routes not removed in %s", brokerA.OwnName)
+}
+
+func TestRouteTable(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := newRouteTable(3)
+	peers := map[string]*msg.Connection{"b": nil, "c": nil}
+	rt.update("b", map[string]int{"a": 1, "c": 1, "d": 1, "e": 2, "f": 3})
+	rt.update("c", map[string]int{"b": 1, "d": 2, "e": 1})
+	rt.update("x", map[string]int{"g": 1})
+
+	// own and direct peers are not routed, routes over max hops are ignored,
+	// routes via peers which are down are ignored
+	assert.Equal(map[string]Route{
+		"d": {Name: "d", Via: "b", Hops: 2},
+		"e": {Name: "e", Via: "c", Hops: 2},
+	}, rt.best("a", peers))
+
+	// split horizon
+	assert.Equal(map[string]int{"c": 1, "e": 2}, vectorFor("b", peers, rt.best("a", peers)))
+
+	rt.remove("c")
+	assert.Equal(Route{Name: "e", Via: "b", Hops: 3}, rt.best("a", peers)["e"])
+}
+
+func TestBroadcast(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "bcast-a", nil)
+	brokerB := newTestBroker(t, "bcast-b", nil, "mem://bcast-a")
+	brokerC := newTestBroker(t, "bcast-c", nil, "mem://bcast-a")
+	waitPeerUp(t, brokerA, "bcast-b")
+	waitPeerUp(t, brokerA, "bcast-c")
+
+	queues := []*queue.Queue{}
+	for _, broker := range []*Broker{brokerA, brokerB, brokerC} {
+		q := queue.NewQueue(10)
+		assert.Nil(broker.RegisterQueue("bcast-q", q))
+		queues = append(queues, q)
+	}
+
+	results := brokerA.Broadcast("bcast-q", []byte("reload"))
+	assert.Equal(map[string]error{"bcast-a": nil, "bcast-b": nil, "bcast-c": nil}, results)
+	for _, q := range queues {
+		assert.Equal([]byte("reload"), q.Get())
+	}
+}
+
+func TestPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "peers-a", nil)
+	brokerB := newTestBroker(t, "peers-b", nil, "mem://peers-a", "mem://peers-x")
+	waitPeerUp(t, brokerA, "peers-b")
+	waitPeerUp(t, brokerB, "peers-a")
+
+	q := queue.NewQueue(10)
+	assert.Nil(brokerA.RegisterQueue("peers-q", q))
+	assert.Nil(brokerB.SendMsg("peers-a", "peers-q", []byte("counted")))
+	q.Get()
+
+	peers := brokerB.PeerInfo()
+	assert.Equal(2, len(peers))
+	assert.Equal("peers-a", peers[0].Name)
+	assert.Equal("mem://peers-a", peers[0].Addr)
+	assert.Equal("up", peers[0].State)
+	assert.False(peers[0].ConnectedSince.IsZero())
+	assert.True(peers[0].SentFrames >= 2)
+	assert.Equal(0, peers[0].RecvMessages)
+
+	// unreachable peer
+	assert.Equal("", peers[1].Name)
+	assert.Equal("mem://peers-x", peers[1].Addr)
+	assert.Equal("down", peers[1].State)
+	assert.True(peers[1].ConnectedSince.IsZero())
+
+	peers = brokerA.PeerInfo()
+	assert.Equal(1, len(peers))
+	assert.Equal("peers-b", peers[0].Name)
+	assert.Equal("", peers[0].Addr)
+	assert.Equal(1, peers[0].RecvMessages)
+	assert.Equal(len("counted"), peers[0].RecvBytes)
+}
+
+// entries returns amount of entries with given name in peer store
+func entries(broker *Broker, name string) int {
+	broker.Peers.RLock()
+	defer broker.Peers.RUnlock()
+
+	count := 0
+	for _, peer := range broker.Peers.peers {
+		if peer.name == name && peer.state == stateUp {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPeersSymmetric(t *testing.T) {
+	assert := assert.New(t)
+
+	// A can't connect to B before B is created so A has entries
+	// for both connections when redialed connection is up
+	options := map[string]interface{}{"reconnect-interval": int(10 * time.Millisecond)}
+	brokerA := newTestBroker(t, "peers-sym-a", options, "mem://peers-sym-b")
+	brokerB := newTestBroker(t, "peers-sym-b", options, "mem://peers-sym-a")
+	testutil.WaitFor(t, func() bool {
+		return entries(brokerA, "peers-sym-b") == 2
+	}, "connections not up")
+	waitPeerUp(t, brokerB, "peers-sym-a")
+
+	for broker, peerName := range map[*Broker]string{brokerA: "peers-sym-b", brokerB: "peers-sym-a"} {
+		peers := broker.PeerInfo()
+		assert.Equal(1, len(peers))
+		assert.Equal(peerName, peers[0].Name)
+		assert.Equal("mem://"+peerName, peers[0].Addr)
+		assert.Equal("up", peers[0].State)
+	}
+}
+
+func TestAddRemovePeer(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "dyn-a", map[string]interface{}{
+		"reconnect-interval": int(10 * time.Millisecond),
+	})
+	brokerB := newTestBroker(t, "dyn-b", nil)
+
+	assert.Nil(brokerA.AddPeer("mem://dyn-b"))
+	err := brokerA.AddPeer("mem://dyn-b")
+	assert.True(errors.Is(err, ErrPeerExists), err)
+	assert.Equal(CodePeerExists, ErrorCode(err))
+	waitPeerEvent(t, brokerA, PeerUp, "dyn-b")
+	waitPeerEvent(t, brokerB, PeerUp, "dyn-a")
+
+	assert.Nil(brokerA.RemovePeer("dyn-b"))
+	err = brokerA.RemovePeer("dyn-x")
+	assert.True(errors.Is(err, ErrUnknownNode), err)
+	assert.Equal(CodeUnknownNode, ErrorCode(err))
+	waitPeerEvent(t, brokerA, PeerDown, "dyn-b")
+	waitPeerEvent(t, brokerB, PeerDown, "dyn-a")
+
+	// removed peer is not reconnected
+	time.Sleep(50 * time.Millisecond)
+	_, err = brokerA.Peers.getPeerByName("dyn-b")
+	assert.NotNil(err)
+	assert.NotNil(brokerA.SendMsg("dyn-b", "dyn-q", []byte("removed")))
+
+	// peer can be added again
+	assert.Nil(brokerA.AddPeer("mem://dyn-b"))
+	waitPeerEvent(t, brokerA, PeerUp, "dyn-b")
+}
+
+func TestAddPeerConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newTestBroker(t, "dyn-conc-a", nil)
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			results <- broker.AddPeer("mem://dyn-conc-x")
+		}()
+	}
+	added := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			added++
+		} else {
+			assert.True(errors.Is(err, ErrPeerExists), err)
+		}
+	}
+	assert.Equal(1, added)
+	assert.Equal(1, len(broker.PeerInfo()))
+}
+
+func TestRemovePeerSymmetric(t *testing.T) {
+	assert := assert.New(t)
+
+	// both brokers have address of other
+	options := map[string]interface{}{"reconnect-interval": int(10 * time.Millisecond)}
+	brokerA := newTestBroker(t, "sym-a", options, "mem://sym-b")
+	brokerB := newTestBroker(t, "sym-b", options, "mem://sym-a")
+	waitPeerUp(t, brokerA, "sym-b")
+	waitPeerUp(t, brokerB, "sym-a")
+
+	assert.Nil(brokerA.RemovePeer("sym-b"))
+	waitPeerEvent(t, brokerA, PeerDown, "sym-b")
+
+	// peer redialing is rejected
+	var lock sync.Mutex
+	events := []PeerEvent{}
+	brokerA.WatchPeers(func(event PeerEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	assert.Equal([]PeerEvent{}, events)
+	lock.Unlock()
+	_, err := brokerA.Peers.getPeerByName("sym-b")
+	assert.NotNil(err)
+	for _, peer := range brokerA.PeerInfo() {
+		assert.NotEqual("up", peer.State, peer.Name)
+	}
+
+	// peer can be added again
+	assert.Nil(brokerA.AddPeer("mem://sym-b"))
+	waitPeerUp(t, brokerA, "sym-b")
+}
+
+func TestWatchPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "watch-a", nil)
+	events := make(chan PeerEvent, 10)
+	brokerA.WatchPeers(func(event PeerEvent) {
+		events <- event
+	})
+
+	brokerB := newTestBroker(t, "watch-b", nil, "mem://watch-a")
+	event := <-events
+	assert.Equal(PeerUp, event.Type)
+	assert.Equal("watch-b", event.Name)
+	assert.Equal("connected", event.Reason)
+
+	// closed connection may be noticed before leave message
+	brokerB.Close()
+	event = <-events
+	assert.Equal(PeerDown, event.Type)
+	assert.Equal("watch-b", event.Name)
+	assert.Contains([]string{"left", "connection lost"}, event.Reason)
+}
+
+func TestWatchPeersSymmetric(t *testing.T) {
+	assert := assert.New(t)
+
+	options := map[string]interface{}{"reconnect-interval": int(10 * time.Millisecond)}
+	brokerA := newTestBroker(t, "watch-sym-a", options, "mem://watch-sym-b")
+	var lock sync.Mutex
+	events := []PeerEvent{}
+	brokerA.WatchPeers(func(event PeerEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+	getEvents := func() []PeerEvent {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]PeerEvent{}, events...)
+	}
+
+	// one event although there are connections in both directions
+	brokerB := newTestBroker(t, "watch-sym-b", options, "mem://watch-sym-a")
+	testutil.WaitFor(t, func() bool {
+		return entries(brokerA, "watch-sym-b") == 2
+	}, "connections not up")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(1, len(getEvents()))
+	assert.Equal(PeerUp, getEvents()[0].Type)
+
+	// losing one of connections doesn't make peer down
+	brokerA.Peers.Lock()
+	for _, peer := range brokerA.Peers.peers {
+		if peer.addr == "" {
+			peer.conn.Close()
+		}
+	}
+	brokerA.Peers.Unlock()
+	testutil.WaitFor(t, func() bool {
+		return entries(brokerA, "watch-sym-b") == 1
+	}, "connection not down")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(1, len(getEvents()))
+	assert.Equal("up", brokerA.PeerInfo()[0].State)
+
+	brokerB.Close()
+	testutil.WaitFor(t, func() bool {
+		return len(getEvents()) == 2
+	}, "peer-down not received")
+	assert.Equal(PeerDown, getEvents()[1].Type)
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "close-a", map[string]interface{}{
+		"close-queues": true,
+		"gossip":       true,
+		"routing":      true,
+	})
+	brokerB := newTestBroker(t, "close-b", nil, "mem://close-a")
+	waitPeerUp(t, brokerA, "close-b")
+
+	q := queue.NewQueue(10)
+	assert.Nil(brokerA.RegisterQueue("close-q", q))
+
+	brokerA.Close()
+	brokerA.Close()
+	waitPeerEvent(t, brokerB, PeerDown, "close-a")
+	assert.True(q.IsClosed())
+
+	assert.Equal(ErrBrokerClosed, brokerA.SendMsg("close-a", "close-q", []byte("local")))
+	assert.Equal(ErrBrokerClosed, brokerA.SendMsg("close-b", "close-q", []byte("remote")))
+	assert.Equal(ErrBrokerClosed, brokerA.RegisterQueue("close-q", q))
+	assert.Equal(ErrBrokerClosed, brokerA.AddPeer("mem://close-b"))
+	assert.Equal(map[string]error{"close-a": ErrBrokerClosed}, brokerA.Broadcast("close-q", []byte("all")))
+	assert.NotNil(brokerB.SendMsg("close-a", "close-q", []byte("to closed")))
+
+	// address can be reused
+	newTestBroker(t, "close-a", nil, "mem://close-b")
+	waitPeerEvent(t, brokerB, PeerUp, "close-a")
+}
+
+func TestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "errors-a", nil)
+	brokerB := newTestBroker(t, "errors-b", nil, "mem://errors-a")
+	waitPeerUp(t, brokerA, "errors-b")
+
+	err := brokerA.SendMsg("nobody", "q", []byte("data"))
+	assert.True(errors.Is(err, ErrUnknownNode))
+	assert.Equal(CodeUnknownNode, ErrorCode(err))
+
+	err = brokerA.SendMsg("errors-a", "no-such-queue", []byte("data"))
+	assert.True(errors.Is(err, ErrQueueNotFound))
+	assert.Equal(CodeQueueNotFound, ErrorCode(err))
+
+	q := queue.NewQueue(1)
+	assert.Nil(brokerA.RegisterQueue("errors-q", q))
+	assert.Nil(brokerA.SendMsg("errors-a", "errors-q", []byte("first")))
+	err = brokerA.SendMsg("errors-a", "errors-q", []byte("second"))
+	assert.True(errors.Is(err, ErrQueueFull))
+	assert.Equal(CodeQueueFull, ErrorCode(err))
+
+	brokerB.Close()
+	waitPeerEvent(t, brokerA, PeerDown, "errors-b")
+	err = brokerA.SendMsg("errors-b", "q", []byte("data"))
+	assert.True(errors.Is(err, ErrPeerDown))
+	assert.Equal(CodePeerDown, ErrorCode(err))
+
+	assert.Equal("", ErrorCode(nil))
+	assert.Equal(msg.CodeTimeout, ErrorCode(msg.ErrTimeout))
+}
+
+func TestSendMsgAcked(t *testing.T) {
+	assert := assert.New(t)
+
+	brokerA := newTestBroker(t, "acked-a", map[string]interface{}{
+		"ack-timeout": int(50 * time.Millisecond),
+		"ack-retries": 1,
+	})
+	brokerB := newTestBroker(t, "acked-b", nil, "mem://acked-a")
+	waitPeerUp(t, brokerA, "acked-b")
+
+	q := queue.NewQueue(1)
+	assert.Nil(brokerB.RegisterQueue("acked-q", q))
+	assert.Nil(brokerA.SendMsgAcked("acked-b", "acked-q", []byte("first")))
+
+	err := brokerA.SendMsgAcked("acked-b", "acked-q", []byte("second"))
+	assert.True(errors.Is(err, ErrQueueFull))
+	assert.Equal(CodeQueueFull, ErrorCode(err))
+	assert.Equal([]byte("first"), q.Get())
+
+	err = brokerA.SendMsgAcked("acked-b", "no-such-queue", []byte("lost"))
+	assert.True(errors.Is(err, ErrQueueNotFound))
+	assert.Equal(CodeQueueNotFound, ErrorCode(err))
+
+	// local queue
+	qA := queue.NewQueue(1)
+	assert.Nil(brokerA.RegisterQueue("acked-q", qA))
+	assert.Nil(brokerA.SendMsgAcked("acked-a", "acked-q", []byte("local")))
+	assert.Equal([]byte("local"), qA.Get())
+
+	// retried until retries are used
+	start := time.Now()
+	err = brokerA.SendMsgAcked("acked-x", "acked-q", []byte("lost"))
+	assert.True(errors.Is(err, ErrUnknownNode))
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	brokerB.Close()
+	waitPeerEvent(t, brokerA, PeerDown, "acked-b")
+	err = brokerA.SendMsgAcked("acked-b", "acked-q", []byte("lost"))
+	assert.True(errors.Is(err, ErrPeerDown))
+}
+
+func TestHopAckTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newTestBroker(t, "hop-ack", map[string]interface{}{"ack-timeout": int(time.Second)})
+
+	// forwarding broker waits shorter time than sender
+	assert.Equal(150*time.Millisecond, broker.hopAckTimeout(200*time.Millisecond))
+	assert.Equal(750*time.Millisecond, broker.hopAckTimeout(0))
+}
@@ -1,6 +1,8 @@
 package bro
 
 import (
+	"fmt"
+
 	"github.com/anssihalmeaho/mzq/msg"
 	"github.com/anssihalmeaho/mzq/queue"
 
@@ -29,6 +31,30 @@ func InitBro(interpreter *funl.Interpreter) (err error) {
 			Name:   "send-msg",
 			Getter: GetSendMsg,
 		},
+		{
+			Name:   "send-msg-acked",
+			Getter: GetSendMsgAcked,
+		},
+		{
+			Name:   "broadcast-msg",
+			Getter: GetBroadcastMsg,
+		},
+		{
+			Name:   "add-peer",
+			Getter: GetAddPeer,
+		},
+		{
+			Name:   "remove-peer",
+			Getter: GetRemovePeer,
+		},
+		{
+			Name:   "watch-peers",
+			Getter: GetWatchPeers,
+		},
+		{
+			Name:   "get-peers",
+			Getter: GetPeers,
+		},
 		{
 			Name:   "close",
 			Getter: GetClose,
@@ -57,45 +83,258 @@ func GetSendMsg(name string) std.StdFuncType {
 		nodeName := arguments[1].Data.(string)
 		qname := arguments[2].Data.(string)
 
-		// encode data
-		args := []*funl.Item{
-			&funl.Item{
-				Type: funl.ValueItem,
-				Data: broker.encoder,
-			},
-			&funl.Item{
-				Type: funl.ValueItem,
-				Data: arguments[3],
-			},
+		data, err := broker.encode(frame, arguments[3])
+		if err == nil {
+			err = broker.bro.SendMsg(nodeName, qname, data)
 		}
+		retVal = makeResult(frame, err)
+		return
+	}
+}
 
-		dataStrVal := funl.HandleCallOP(frame, args)
-		dataStr := dataStrVal.Data.(string)
-		err := broker.bro.SendMsg(nodeName, qname, []byte(dataStr))
+// GetSendMsgAcked ...
+func GetSendMsgAcked(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 4 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+		if arguments[2].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+		broker := arguments[0].Data.(*OpaqueBroker)
+		nodeName := arguments[1].Data.(string)
+		qname := arguments[2].Data.(string)
 
-		var isOK bool
-		var errorText string
+		data, err := broker.encode(frame, arguments[3])
 		if err == nil {
-			isOK = true
-		} else {
-			errorText = err.Error()
+			err = broker.bro.SendMsgAcked(nodeName, qname, data)
 		}
+		retVal = makeResult(frame, err)
+		return
+	}
+}
 
-		values := []funl.Value{
-			{
-				Kind: funl.BoolValue,
-				Data: isOK,
-			},
-			{
-				Kind: funl.StringValue,
-				Data: errorText,
-			},
+// GetBroadcastMsg ...
+func GetBroadcastMsg(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 3 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d)", name, l)
 		}
-		retVal = funl.MakeListOfValues(frame, values)
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+		broker := arguments[0].Data.(*OpaqueBroker)
+		qname := arguments[1].Data.(string)
+
+		data, err := broker.encode(frame, arguments[2])
+		if err != nil {
+			retVal = msg.MakeMap(frame, []string{broker.bro.OwnName}, []funl.Value{makeResult(frame, err)})
+			return
+		}
+		results := broker.bro.Broadcast(qname, data)
+		names := []string{}
+		values := []funl.Value{}
+		for nodeName, err := range results {
+			names = append(names, nodeName)
+			values = append(values, makeResult(frame, err))
+		}
+		retVal = msg.MakeMap(frame, names, values)
 		return
 	}
 }
 
+// GetAddPeer ...
+func GetAddPeer(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 2 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+		broker := arguments[0].Data.(*OpaqueBroker)
+		err := broker.bro.AddPeer(arguments[1].Data.(string))
+		retVal = makeResult(frame, err)
+		return
+	}
+}
+
+// GetRemovePeer ...
+func GetRemovePeer(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 2 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+		broker := arguments[0].Data.(*OpaqueBroker)
+		err := broker.bro.RemovePeer(arguments[1].Data.(string))
+		retVal = makeResult(frame, err)
+		return
+	}
+}
+
+// GetWatchPeers ...
+func GetWatchPeers(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 2 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		broker := arguments[0].Data.(*OpaqueBroker)
+		oq, ok := arguments[1].Data.(*queue.OpaqueQueue)
+		if !ok {
+			funl.RunTimeError2(frame, "%s: requires queue", name)
+		}
+		q := oq.GetQinside()
+
+		// events are dropped if queue is full
+		broker.bro.WatchPeers(func(event PeerEvent) {
+			eventName := "up"
+			if event.Type == PeerDown {
+				eventName = "down"
+			}
+			names := []string{"event", "node", "addr", "reason"}
+			values := []funl.Value{
+				{Kind: funl.StringValue, Data: eventName},
+				{Kind: funl.StringValue, Data: event.Name},
+				{Kind: funl.StringValue, Data: event.Addr},
+				{Kind: funl.StringValue, Data: event.Reason},
+			}
+			q.PutNoWait(msg.MakeMap(frame, names, values))
+		})
+		retVal = funl.Value{Kind: funl.BoolValue, Data: true}
+		return
+	}
+}
+
+// GetPeers ...
+func GetPeers(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		broker := arguments[0].Data.(*OpaqueBroker)
+
+		peers := []funl.Value{}
+		for _, peer := range broker.bro.PeerInfo() {
+			var since int
+			if !peer.ConnectedSince.IsZero() {
+				since = int(peer.ConnectedSince.UnixNano())
+			}
+			names := []string{
+				"name",
+				"addr",
+				"recv-addr",
+				"addrs",
+				"state",
+				"discovered",
+				"connected-since",
+				"sent-frames",
+				"sent-bytes",
+				"recv-messages",
+				"recv-bytes",
+			}
+			values := []funl.Value{
+				{Kind: funl.StringValue, Data: peer.Name},
+				{Kind: funl.StringValue, Data: peer.Addr},
+				{Kind: funl.StringValue, Data: peer.RecvAddr},
+				msg.MakeStringList(frame, peer.Addrs),
+				{Kind: funl.StringValue, Data: peer.State},
+				{Kind: funl.BoolValue, Data: peer.Discovered},
+				{Kind: funl.IntValue, Data: since},
+				{Kind: funl.IntValue, Data: peer.SentFrames},
+				{Kind: funl.IntValue, Data: peer.SentBytes},
+				{Kind: funl.IntValue, Data: peer.RecvMessages},
+				{Kind: funl.IntValue, Data: peer.RecvBytes},
+			}
+			peers = append(peers, msg.MakeMap(frame, names, values))
+		}
+		retVal = funl.MakeListOfValues(frame, peers)
+		return
+	}
+}
+
+// encode encodes FunL value to be sent in message, values which
+// can't be serialized (like functions) cause runtime error in encoder
+// which is returned as ErrEncodeFailed
+func (bro *OpaqueBroker) encode(frame *funl.Frame, value funl.Value) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("%w: %v", ErrEncodeFailed, r)
+		}
+	}()
+
+	args := []*funl.Item{
+		&funl.Item{
+			Type: funl.ValueItem,
+			Data: bro.encoder,
+		},
+		&funl.Item{
+			Type: funl.ValueItem,
+			Data: value,
+		},
+	}
+	// encoder returns list(ok:bool error:string data:string)
+	it := funl.NewListIterator(funl.HandleCallOP(frame, args))
+	okv, errv, datav := *(it.Next()), *(it.Next()), *(it.Next())
+	if ok, _ := okv.Data.(bool); !ok {
+		return nil, fmt.Errorf("%w: %v", ErrEncodeFailed, errv.Data)
+	}
+	return []byte(datav.Data.(string)), nil
+}
+
+// makeResult makes list(ok:bool error:string code:string) from error
+func makeResult(frame *funl.Frame, err error) funl.Value {
+	var isOK bool
+	var errorText string
+	if err == nil {
+		isOK = true
+	} else {
+		errorText = err.Error()
+	}
+
+	values := []funl.Value{
+		{
+			Kind: funl.BoolValue,
+			Data: isOK,
+		},
+		{
+			Kind: funl.StringValue,
+			Data: errorText,
+		},
+		{
+			Kind: funl.StringValue,
+			Data: ErrorCode(err),
+		},
+	}
+	return funl.MakeListOfValues(frame, values)
+}
+
 // GetUnRegQueue ...
 func GetUnRegQueue(name string) std.StdFuncType {
 	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
@@ -112,25 +351,7 @@ func GetUnRegQueue(name string) std.StdFuncType {
 		qname := arguments[1].Data.(string)
 		err := broker.bro.UnRegisterQueue(qname)
 
-		var isOK bool
-		var errorText string
-		if err == nil {
-			isOK = true
-		} else {
-			errorText = err.Error()
-		}
-
-		values := []funl.Value{
-			{
-				Kind: funl.BoolValue,
-				Data: isOK,
-			},
-			{
-				Kind: funl.StringValue,
-				Data: errorText,
-			},
-		}
-		retVal = funl.MakeListOfValues(frame, values)
+		retVal = makeResult(frame, err)
 		return
 	}
 }
@@ -155,25 +376,7 @@ func GetRegQueue(name string) std.StdFuncType {
 		oq := arguments[2].Data.(*queue.OpaqueQueue)
 		err := broker.bro.RegisterQueue(qname, oq.GetQinside())
 
-		var isOK bool
-		var errorText string
-		if err == nil {
-			isOK = true
-		} else {
-			errorText = err.Error()
-		}
-
-		values := []funl.Value{
-			{
-				Kind: funl.BoolValue,
-				Data: isOK,
-			},
-			{
-				Kind: funl.StringValue,
-				Data: errorText,
-			},
-		}
-		retVal = funl.MakeListOfValues(frame, values)
+		retVal = makeResult(frame, err)
 		return
 	}
 }
@@ -202,7 +405,7 @@ func GetNewBroker(name string) std.StdFuncType {
 				Type: funl.ValueItem,
 				Data: funl.Value{
 					Kind: funl.StringValue,
-					Data: "call(proc() import stdser import stdbytes proc(x) _ _ b = call(stdser.encode x): call(stdbytes.string b) end end)",
+					Data: "call(proc() import stdser import stdbytes proc(__x) __ok __err __b = call(stdser.encode __x): if(__ok list(__ok __err call(stdbytes.string __b)) list(__ok __err '')) end end)",
 				},
 			}
 			return funl.HandleEvalOP(frame, []*funl.Item{decItem})
@@ -275,6 +478,10 @@ func GetNewBroker(name string) std.StdFuncType {
 				Data: errorText,
 			},
 			val,
+			{
+				Kind: funl.StringValue,
+				Data: ErrorCode(err),
+			},
 		}
 		retVal = funl.MakeListOfValues(frame, values)
 		return
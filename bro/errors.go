@@ -0,0 +1,54 @@
+package bro
+
+import (
+	"errors"
+
+	"github.com/anssihalmeaho/mzq/msg"
+)
+
+// Broker errors, returned errors may contain more details
+// (check with errors.Is)
+var (
+	ErrBrokerClosed  = errors.New("broker closed")
+	ErrUnknownNode   = errors.New("unknown node")
+	ErrPeerDown      = errors.New("peer down")
+	ErrQueueNotFound = errors.New("queue not found")
+	ErrQueueFull     = errors.New("queue full")
+	ErrEncodeFailed  = errors.New("encode failed")
+	ErrPeerExists    = errors.New("peer already added")
+)
+
+// Error codes of broker errors (in addition to msg error codes)
+const (
+	CodeBrokerClosed  = "broker-closed"
+	CodeUnknownNode   = "unknown-node"
+	CodePeerDown      = "peer-down"
+	CodeQueueNotFound = "queue-not-found"
+	CodeQueueFull     = "queue-full"
+	CodeEncodeFailed  = "encode-failed"
+	CodePeerExists    = "peer-exists"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrBrokerClosed, CodeBrokerClosed},
+	{ErrUnknownNode, CodeUnknownNode},
+	{ErrPeerDown, CodePeerDown},
+	{ErrQueueNotFound, CodeQueueNotFound},
+	{ErrQueueFull, CodeQueueFull},
+	{ErrEncodeFailed, CodeEncodeFailed},
+	{ErrPeerExists, CodePeerExists},
+}
+
+// ErrorCode returns error code of error (empty string for nil),
+// for errors from messaging msg.ErrorCode is used
+func ErrorCode(err error) string {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return msg.ErrorCode(err)
+}
@@ -0,0 +1,548 @@
+package bro
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/msg"
+)
+
+// Gossip based membership (SWIM-like) is enabled with 'gossip' option.
+// Every gossip interval broker:
+//  - sends its member list to random peers, so members spread through
+//    cluster and new members are connected to (one seed address is enough)
+//  - probes one random member and if there's no ack in probe timeout asks
+//    other peers to probe it (indirect probe), member which does not answer
+//    is suspected and declared dead if suspicion is not refuted in suspect
+//    timeout (member refutes suspicion by increasing its incarnation number)
+
+// default gossip settings
+const (
+	defaultGossipInterval = time.Second
+	gossipFanout          = 3
+	probeHelpers          = 3
+	deadRetentionFactor   = 10
+)
+
+// MemberStatus is status of cluster member
+type MemberStatus int
+
+// Member statuses
+const (
+	MemberAlive MemberStatus = iota + 1
+	MemberSuspect
+	MemberDead
+)
+
+func (status MemberStatus) String() string {
+	switch status {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member is broker in cluster (learned by gossip)
+type Member struct {
+	Name        string       `json:"name"`
+	Addrs       []string     `json:"addrs"`
+	Incarnation int          `json:"inc"`
+	Status      MemberStatus `json:"status"`
+}
+
+type memberEntry struct {
+	Member
+	changed time.Time
+}
+
+type gossipConfig struct {
+	interval       time.Duration
+	probeTimeout   time.Duration
+	suspectTimeout time.Duration
+}
+
+type gossipMsg struct {
+	From    string   `json:"from"`
+	Members []Member `json:"members"`
+}
+
+type probeMsg struct {
+	From   string `json:"from"`
+	Seq    int    `json:"seq"`
+	Target string `json:"target,omitempty"`
+}
+
+// membership is member list of broker
+type membership struct {
+	config  gossipConfig
+	own     string
+	members map[string]*memberEntry
+	acks    map[int]chan struct{}
+	seq     int
+	lock    sync.Mutex
+}
+
+// gossipOptions reads gossip options, returns nil if gossip is not enabled
+func gossipOptions(options map[string]interface{}) (*gossipConfig, error) {
+	if v, found := options["gossip"]; !found || v != true {
+		return nil, nil
+	}
+	config := &gossipConfig{interval: defaultGossipInterval}
+	durations := []struct {
+		name string
+		d    *time.Duration
+	}{
+		{"gossip-interval", &config.interval},
+		{"probe-timeout", &config.probeTimeout},
+		{"suspect-timeout", &config.suspectTimeout},
+	}
+	for _, opt := range durations {
+		if v, found := options[opt.name]; found {
+			d, ok := v.(int)
+			if !ok || d <= 0 {
+				return nil, fmt.Errorf("Invalid format for %s", opt.name)
+			}
+			*opt.d = time.Duration(d)
+		}
+	}
+	if config.probeTimeout <= 0 {
+		config.probeTimeout = config.interval / 3
+	}
+	if config.suspectTimeout <= 0 {
+		config.suspectTimeout = 5 * config.interval
+	}
+	return config, nil
+}
+
+func newMembership(config gossipConfig, own Member) *membership {
+	return &membership{
+		config:  config,
+		own:     own.Name,
+		members: map[string]*memberEntry{own.Name: {Member: own, changed: time.Now()}},
+		acks:    map[int]chan struct{}{},
+	}
+}
+
+// list returns members sorted by name
+func (ms *membership) list() []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	result := []Member{}
+	for _, entry := range ms.members {
+		result = append(result, entry.Member)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// setOwnAddrs updates own addresses
+func (ms *membership) setOwnAddrs(addrs []string) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.members[ms.own].Addrs = addrs
+}
+
+// merge merges received member list, returns members which became dead
+func (ms *membership) merge(received []Member) []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	dead := []Member{}
+	for _, m := range received {
+		if m.Name == ms.own {
+			self := ms.members[ms.own]
+			if m.Status != MemberAlive && m.Incarnation >= self.Incarnation {
+				// refute suspicion
+				self.Incarnation = m.Incarnation + 1
+				self.changed = time.Now()
+			}
+			continue
+		}
+		cur, found := ms.members[m.Name]
+		switch {
+		case !found:
+			if m.Status == MemberDead {
+				continue
+			}
+		case m.Incarnation > cur.Incarnation:
+		case m.Incarnation == cur.Incarnation && m.Status > cur.Status:
+		default:
+			continue
+		}
+		if m.Status == MemberDead && found && cur.Status != MemberDead {
+			dead = append(dead, m)
+		}
+		ms.members[m.Name] = &memberEntry{Member: m, changed: time.Now()}
+	}
+	return dead
+}
+
+// setStatus sets status of member (with current incarnation),
+// returns false if status was not changed
+func (ms *membership) setStatus(name string, status MemberStatus) (Member, bool) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	entry, found := ms.members[name]
+	if !found || name == ms.own || entry.Status >= status {
+		return Member{}, false
+	}
+	entry.Status = status
+	entry.changed = time.Now()
+	return entry.Member, true
+}
+
+// expire declares suspects dead after suspect timeout and removes dead
+// members after retention time, returns members which became dead
+func (ms *membership) expire() []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	now := time.Now()
+	dead := []Member{}
+	for name, entry := range ms.members {
+		switch entry.Status {
+		case MemberSuspect:
+			if now.Sub(entry.changed) > ms.config.suspectTimeout {
+				entry.Status = MemberDead
+				entry.changed = now
+				dead = append(dead, entry.Member)
+			}
+		case MemberDead:
+			if now.Sub(entry.changed) > deadRetentionFactor*ms.config.suspectTimeout {
+				delete(ms.members, name)
+			}
+		}
+	}
+	return dead
+}
+
+// probeTarget returns random member (not dead) to be probed
+func (ms *membership) probeTarget() (string, bool) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	candidates := []string{}
+	for name, entry := range ms.members {
+		if name != ms.own && entry.Status != MemberDead {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+func (ms *membership) newProbe() (int, chan struct{}) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.seq++
+	ackCh := make(chan struct{}, 1)
+	ms.acks[ms.seq] = ackCh
+	return ms.seq, ackCh
+}
+
+func (ms *membership) removeProbe(seq int) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.acks, seq)
+}
+
+func (ms *membership) ack(seq int) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if ackCh, found := ms.acks[seq]; found {
+		// non-blocking send
+		select {
+		case ackCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitAck waits ack of probe, returns false if there's no ack in
+// timeout or if broker is closed
+func (broker *Broker) waitAck(ackCh chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ackCh:
+		return true
+	case <-timer.C:
+		return false
+	case <-broker.stop:
+		return false
+	}
+}
+
+// sendBrokerMsg sends broker protocol message with given data
+func sendBrokerMsg(con *msg.Connection, msgName string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msgData, err := json.Marshal(&msgFormat{MsgName: msgName, Data: b})
+	if err != nil {
+		return err
+	}
+	return con.Send(string(msgData))
+}
+
+// getUpPeers returns connections of peers which are up (by name)
+func (ps *PeerStore) getUpPeers() map[string]*msg.Connection {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	result := map[string]*msg.Connection{}
+	for _, v := range ps.peers {
+		if v.state == stateUp && v.name != "" {
+			result[v.name] = v.conn
+		}
+	}
+	return result
+}
+
+func hasAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// addDiscovered adds member as discovered peer unless it's connected
+// or being connected already (checking and adding is done at once so
+// member is not added twice), returns id of added peer
+func (ps *PeerStore) addDiscovered(m Member) (int, bool) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if _, removed := ps.removed[m.Name]; removed {
+		return 0, false
+	}
+	for _, v := range ps.peers {
+		if v.name == m.Name && v.state == stateUp {
+			return 0, false
+		}
+		if v.addr != "" && hasAddr(m.Addrs, v.addr) {
+			return 0, false
+		}
+	}
+	ps.peers = append(ps.peers, &peerInfo{addr: m.Addrs[0], discovered: true})
+	return len(ps.peers) - 1, true
+}
+
+// forget stops reconnecting discovered peer
+func (ps *PeerStore) forget(m Member) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, v := range ps.peers {
+		if v.discovered && (v.name == m.Name || hasAddr(m.Addrs, v.addr)) {
+			v.addr = ""
+		}
+	}
+}
+
+// randomPeers returns at most n random connections (except excluded name)
+func randomPeers(peers map[string]*msg.Connection, n int, exclude string) []*msg.Connection {
+	names := []string{}
+	for name := range peers {
+		if name != exclude {
+			names = append(names, name)
+		}
+	}
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	if len(names) > n {
+		names = names[:n]
+	}
+	result := []*msg.Connection{}
+	for _, name := range names {
+		result = append(result, peers[name])
+	}
+	return result
+}
+
+// Members returns members of cluster known by broker
+// (empty if gossip is not enabled)
+func (broker *Broker) Members() []Member {
+	if broker.members == nil {
+		return []Member{}
+	}
+	return broker.members.list()
+}
+
+func (broker *Broker) gossiper() {
+	ticker := time.NewTicker(broker.members.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-broker.stop:
+			return
+		case <-ticker.C:
+			broker.gossipRound()
+		case <-broker.memberTrigger:
+			broker.connectMembers()
+		}
+	}
+}
+
+func (broker *Broker) gossipRound() {
+	for _, m := range broker.members.expire() {
+		broker.memberDead(m)
+	}
+	broker.members.setOwnAddrs(broker.Addrs())
+	broker.connectMembers()
+
+	peers := broker.Peers.getUpPeers()
+	gossip := &gossipMsg{From: broker.OwnName, Members: broker.members.list()}
+	for _, con := range randomPeers(peers, gossipFanout, "") {
+		if err := sendBrokerMsg(con, "gossip", gossip); err != nil {
+			broker.log(msg.LevelDebug, "Gossip send failed", "error", err)
+		}
+	}
+
+	if target, found := broker.members.probeTarget(); found {
+		broker.start(func() { broker.probe(target, peers) })
+	}
+}
+
+// triggerMembers makes gossiper connect to new members without waiting
+// interval (dialing is done only in gossiper, not in receiver)
+func (broker *Broker) triggerMembers() {
+	select {
+	case broker.memberTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// connectMembers connects to alive members which are not connected
+func (broker *Broker) connectMembers() {
+	for _, m := range broker.members.list() {
+		if m.Name == broker.OwnName || m.Status != MemberAlive || len(m.Addrs) == 0 {
+			continue
+		}
+		id, added := broker.Peers.addDiscovered(m)
+		if !added {
+			continue
+		}
+		broker.log(msg.LevelDebug, "Connecting to member", "peer", m.Name, "addr", m.Addrs[0])
+		broker.connectPeer(id, m.Addrs[0], msg.LevelDebug)
+	}
+}
+
+func (broker *Broker) memberDead(m Member) {
+	broker.log(msg.LevelInfo, "Member dead", "peer", m.Name)
+	broker.Peers.forget(m)
+}
+
+// probe probes member directly and if needed indirectly via other peers,
+// member is suspected if there's no ack
+func (broker *Broker) probe(target string, peers map[string]*msg.Connection) {
+	seq, ackCh := broker.members.newProbe()
+	defer broker.members.removeProbe(seq)
+
+	probe := &probeMsg{From: broker.OwnName, Seq: seq}
+	if con, found := peers[target]; found {
+		if sendBrokerMsg(con, "probe", probe) == nil && broker.waitAck(ackCh, broker.members.config.probeTimeout) {
+			return
+		}
+	}
+	if broker.isClosed() {
+		return
+	}
+
+	probeReq := &probeMsg{From: broker.OwnName, Seq: seq, Target: target}
+	for _, con := range randomPeers(peers, probeHelpers, target) {
+		sendBrokerMsg(con, "probe-req", probeReq)
+	}
+	if broker.waitAck(ackCh, broker.members.config.interval-broker.members.config.probeTimeout) || broker.isClosed() {
+		return
+	}
+	if m, changed := broker.members.setStatus(target, MemberSuspect); changed {
+		broker.log(msg.LevelInfo, "Member suspected", "peer", m.Name)
+	}
+}
+
+// probeFor probes target for other member (indirect probe)
+func (broker *Broker) probeFor(requester *msg.Connection, req probeMsg) {
+	con, err := broker.Peers.getPeerByName(req.Target)
+	if err != nil {
+		return
+	}
+	seq, ackCh := broker.members.newProbe()
+	defer broker.members.removeProbe(seq)
+
+	if sendBrokerMsg(con, "probe", &probeMsg{From: broker.OwnName, Seq: seq}) != nil {
+		return
+	}
+	if broker.waitAck(ackCh, broker.members.config.probeTimeout) {
+		sendBrokerMsg(requester, "probe-ack", &probeMsg{From: broker.OwnName, Seq: req.Seq})
+	}
+}
+
+// handleGossip handles gossip protocol messages
+func (broker *Broker) handleGossip(received msg.Msg, msgform msgFormat) {
+	if broker.members == nil {
+		return
+	}
+	switch msgform.MsgName {
+	case "gossip":
+		var gossip gossipMsg
+		if err := json.Unmarshal(msgform.Data, &gossip); err != nil {
+			broker.log(msg.LevelWarn, "Gossip msg decode failed", "addr", received.FromAddr, "error", err)
+			return
+		}
+		// sender may advertise unspecified host (like [::]) for itself,
+		// it's replaced with host which sender is seen from
+		for i, m := range gossip.Members {
+			if m.Name == gossip.From {
+				gossip.Members[i].Addrs = resolveAddrs(m.Addrs, received.FromAddr)
+			}
+		}
+		for _, m := range broker.members.merge(gossip.Members) {
+			broker.memberDead(m)
+		}
+		broker.triggerMembers()
+
+	case "probe", "probe-req", "probe-ack":
+		var probe probeMsg
+		if err := json.Unmarshal(msgform.Data, &probe); err != nil {
+			broker.log(msg.LevelWarn, "Probe msg decode failed", "addr", received.FromAddr, "error", err)
+			return
+		}
+		if msgform.MsgName == "probe-ack" {
+			broker.members.ack(probe.Seq)
+			return
+		}
+		con, err := broker.openConnection(received.FromAddr)
+		if err != nil {
+			return
+		}
+		if msgform.MsgName == "probe-req" {
+			broker.start(func() { broker.probeFor(con, probe) })
+			return
+		}
+		err = sendBrokerMsg(con, "probe-ack", &probeMsg{From: broker.OwnName, Seq: probe.Seq})
+		if err != nil {
+			broker.log(msg.LevelDebug, "Probe ack send failed", "peer", probe.From, "error", err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package bro
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/msg"
+)
+
+// Peer is information about peer broker
+type Peer struct {
+	Name string
+
+	// Addr is configured (or discovered) address of peer, it's empty
+	// if only peer has connected to this broker
+	Addr string
+
+	// RecvAddr is address from which messages of peer are received
+	RecvAddr string
+
+	// Addrs are listening addresses advertised by peer
+	Addrs []string
+
+	// State is "up", "down" or "closed"
+	State      string
+	Discovered bool
+
+	// ConnectedSince is time when peer came up (zero if peer hasn't been up)
+	ConnectedSince time.Time
+
+	// all frames sent to peer (from connection stats) and
+	// payload messages received from peer
+	SentFrames   int
+	SentBytes    int
+	RecvMessages int
+	RecvBytes    int
+}
+
+func (state peerState) String() string {
+	switch state {
+	case stateDown:
+		return "down"
+	case stateUp:
+		return "up"
+	case stateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// liveness orders states, peer with several entries (connections
+// in both directions) is in state of its most alive entry
+func (state peerState) liveness() int {
+	switch state {
+	case stateUp:
+		return 2
+	case stateDown:
+		return 1
+	}
+	return 0
+}
+
+// countReceived counts payload message received from peer
+func (ps *PeerStore) countReceived(recAddr string, bytes int) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, v := range ps.peers {
+		if v.recAddr == recAddr {
+			v.recvMsgs++
+			v.recvBytes += bytes
+			return
+		}
+	}
+}
+
+// getPeers returns one peer per name (entries of same peer are merged),
+// peers which haven't connected yet are returned by address
+func (ps *PeerStore) getPeers() []Peer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	result := []Peer{}
+	states := []peerState{}
+	byName := map[string]int{}
+	counted := map[*msg.Connection]bool{}
+	for _, v := range ps.peers {
+		i, merged := byName[v.name]
+		if !merged {
+			i = len(result)
+			result = append(result, Peer{Name: v.name})
+			states = append(states, v.state)
+			if v.name != "" {
+				byName[v.name] = i
+			}
+		}
+		peer := &result[i]
+		if peer.Addr == "" && v.addr != "" {
+			peer.Addr = v.addr
+			peer.Discovered = v.discovered
+		}
+		if !merged || v.state.liveness() > states[i].liveness() {
+			states[i] = v.state
+			peer.RecvAddr = v.recAddr
+			peer.Addrs = append([]string{}, v.addrs...)
+			peer.ConnectedSince = v.since
+		}
+		peer.RecvMessages += v.recvMsgs
+		peer.RecvBytes += v.recvBytes
+		if v.conn != nil && !counted[v.conn] {
+			counted[v.conn] = true
+			stats := v.conn.Stats()
+			peer.SentFrames += stats.SentFrames
+			peer.SentBytes += stats.SentBytes
+		}
+	}
+	for i := range result {
+		result[i].State = states[i].String()
+	}
+	return result
+}
+
+// PeerInfo returns information about peers (sorted by name, peers which
+// haven't connected yet are last)
+func (broker *Broker) PeerInfo() []Peer {
+	result := broker.Peers.getPeers()
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Name == "" || result[j].Name == "" {
+			return result[j].Name == "" && result[i].Name != ""
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// addPeerAddr adds peer with address unless address is configured
+// for some peer already, returns id of added peer
+func (ps *PeerStore) addPeerAddr(addr string) (int, bool) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, v := range ps.peers {
+		if v.addr == addr {
+			return 0, false
+		}
+	}
+	ps.peers = append(ps.peers, &peerInfo{addr: addr})
+	return len(ps.peers) - 1, true
+}
+
+// removePeer marks all entries of peer closed and clears their addresses
+// (so that peer isn't redialed) and rejects connects from peer until
+// it's added again, returns connections of entries and address of
+// entry which was up (empty if peer wasn't up)
+func (ps *PeerStore) removePeer(name string) (conns []*msg.Connection, found bool, recAddr string) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	// entries still waiting for connect-ack are recognized
+	// by addresses advertised by peer
+	addrs := []string{}
+	for _, v := range ps.peers {
+		if v.name == name {
+			addrs = append(addrs, v.addrs...)
+		}
+	}
+	for _, v := range ps.peers {
+		if v.name != name && (v.name != "" || v.addr == "" || !hasAddr(addrs, v.addr)) {
+			continue
+		}
+		found = true
+		if v.state == stateUp {
+			recAddr = v.recAddr
+		}
+		if v.conn != nil {
+			conns = append(conns, v.conn)
+		}
+		v.addr = ""
+		v.discovered = false
+		v.state = stateClosed
+	}
+	if found {
+		ps.removed[name] = len(ps.peers)
+	}
+	return
+}
+
+// AddPeer adds peer address and connects to it, unreachable peer
+// is reconnected periodically (like peers given in options)
+func (broker *Broker) AddPeer(addr string) error {
+	if broker.isClosed() {
+		return ErrBrokerClosed
+	}
+	id, added := broker.Peers.addPeerAddr(addr)
+	if !added {
+		return fmt.Errorf("%w (%s)", ErrPeerExists, addr)
+	}
+	broker.connectPeer(id, addr, msg.LevelWarn)
+	return nil
+}
+
+// RemovePeer sends leave message to peer and closes connections,
+// peer is not reconnected anymore and connects from peer are rejected
+// until address of peer is added again with AddPeer
+func (broker *Broker) RemovePeer(name string) error {
+	if broker.isClosed() {
+		return ErrBrokerClosed
+	}
+	conns, found, recAddr := broker.Peers.removePeer(name)
+	if !found {
+		return fmt.Errorf("%w (%s)", ErrUnknownNode, name)
+	}
+	for _, conn := range conns {
+		if conn.State() != msg.StateClosed {
+			broker.sendLeave(conn)
+		}
+		conn.Close()
+	}
+	if recAddr != "" {
+		broker.peerEvent(PeerDown, name, recAddr, "removed")
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package bro
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/msg"
+)
+
+// Distance-vector routing is enabled with 'routing' option. Every route
+// interval (and when peers go up or down or routes change) broker sends
+// to its peers hop counts of brokers it can reach. Messages to brokers
+// which are not connected directly are forwarded through peer which
+// has shortest route. Loops are prevented by:
+//  - split horizon: routes are not advertised back to peer they're learned from
+//  - hop limit: routes longer than max hops are ignored and forwarded
+//    messages are dropped when hop limit is reached
+
+// default routing settings
+const (
+	defaultRouteInterval = time.Second
+	defaultMaxHops       = 8
+)
+
+// Route is route to broker which is not directly connected
+type Route struct {
+	Name string
+	Via  string
+	Hops int
+}
+
+type routesMsg struct {
+	From   string         `json:"from"`
+	Routes map[string]int `json:"routes"`
+}
+
+type routingConfig struct {
+	interval time.Duration
+	maxHops  int
+}
+
+// routeTable contains distance vectors advertised by peers
+type routeTable struct {
+	maxHops int
+	vectors map[string]map[string]int
+	lock    sync.Mutex
+}
+
+// routingOptions reads routing options, enabled is false if
+// routing is not enabled (max hops is used anyway for forwarding)
+func routingOptions(options map[string]interface{}) (config routingConfig, enabled bool, err error) {
+	config = routingConfig{interval: defaultRouteInterval, maxHops: defaultMaxHops}
+	if v, found := options["route-interval"]; found {
+		interval, ok := v.(int)
+		if !ok || interval <= 0 {
+			return config, false, fmt.Errorf("Invalid format for route-interval")
+		}
+		config.interval = time.Duration(interval)
+	}
+	if v, found := options["max-hops"]; found {
+		maxHops, ok := v.(int)
+		if !ok || maxHops <= 0 {
+			return config, false, fmt.Errorf("Invalid format for max-hops")
+		}
+		config.maxHops = maxHops
+	}
+	v, found := options["routing"]
+	return config, found && v == true, nil
+}
+
+func newRouteTable(maxHops int) *routeTable {
+	return &routeTable{
+		maxHops: maxHops,
+		vectors: map[string]map[string]int{},
+	}
+}
+
+// update replaces distance vector of peer
+func (rt *routeTable) update(from string, routes map[string]int) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.vectors[from] = routes
+}
+
+// remove removes distance vector of peer (when peer goes down)
+func (rt *routeTable) remove(from string) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	delete(rt.vectors, from)
+}
+
+// best returns shortest routes (by name) to brokers through peers which
+// are up, directly connected peers are not included
+func (rt *routeTable) best(own string, peers map[string]*msg.Connection) map[string]Route {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	result := map[string]Route{}
+	for via, vector := range rt.vectors {
+		if _, up := peers[via]; !up {
+			continue
+		}
+		for name, hops := range vector {
+			if _, direct := peers[name]; direct || name == own {
+				continue
+			}
+			hops++
+			if hops > rt.maxHops {
+				continue
+			}
+			cur, found := result[name]
+			if !found || hops < cur.Hops || (hops == cur.Hops && via < cur.Via) {
+				result[name] = Route{Name: name, Via: via, Hops: hops}
+			}
+		}
+	}
+	return result
+}
+
+// vectorFor returns distance vector advertised to given peer
+func vectorFor(peer string, peers map[string]*msg.Connection, routes map[string]Route) map[string]int {
+	vector := map[string]int{}
+	for name := range peers {
+		if name != peer {
+			vector[name] = 1
+		}
+	}
+	for name, r := range routes {
+		// split horizon
+		if r.Via != peer && name != peer {
+			vector[name] = r.Hops
+		}
+	}
+	return vector
+}
+
+func sameRoutes(a, b map[string]Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, r := range a {
+		if b[name] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// Routes returns routes to brokers which are not directly connected
+// (sorted by name)
+func (broker *Broker) Routes() []Route {
+	if broker.routes == nil {
+		return []Route{}
+	}
+	result := []Route{}
+	for _, r := range broker.routes.best(broker.OwnName, broker.Peers.getUpPeers()) {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// nextHop returns connection to which message to given broker is sent,
+// directly connected peer is preferred over routes
+func (broker *Broker) nextHop(nodeName string) (*msg.Connection, error) {
+	con, err := broker.Peers.getPeerByName(nodeName)
+	if err == nil {
+		return con, nil
+	}
+	if broker.routes != nil {
+		peers := broker.Peers.getUpPeers()
+		if r, found := broker.routes.best(broker.OwnName, peers)[nodeName]; found {
+			return peers[r.Via], nil
+		}
+	}
+	return nil, err
+}
+
+// triggerRoutes makes router advertise routes without waiting interval
+func (broker *Broker) triggerRoutes() {
+	select {
+	case broker.routeTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func (broker *Broker) router(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-broker.stop:
+			return
+		case <-ticker.C:
+		case <-broker.routeTrigger:
+		}
+		broker.advertiseRoutes()
+	}
+}
+
+func (broker *Broker) advertiseRoutes() {
+	peers := broker.Peers.getUpPeers()
+	routes := broker.routes.best(broker.OwnName, peers)
+	for name, con := range peers {
+		advert := &routesMsg{From: broker.OwnName, Routes: vectorFor(name, peers, routes)}
+		if err := sendBrokerMsg(con, "routes", advert); err != nil {
+			broker.log(msg.LevelDebug, "Routes send failed", "peer", name, "error", err)
+		}
+	}
+}
+
+// handleRoutes updates routes advertised by peer, changes are advertised
+// to other peers right away
+func (broker *Broker) handleRoutes(advert routesMsg) {
+	if broker.routes == nil {
+		return
+	}
+	peers := broker.Peers.getUpPeers()
+	before := broker.routes.best(broker.OwnName, peers)
+	broker.routes.update(advert.From, advert.Routes)
+	if !sameRoutes(before, broker.routes.best(broker.OwnName, peers)) {
+		broker.triggerRoutes()
+	}
+}
+
+// forward forwards payload message towards target broker
+func (broker *Broker) forward(msgform msgFormat) {
+	msgform.Hops--
+	if msgform.Hops <= 0 {
+		broker.log(msg.LevelWarn, "Hop limit reached, dropping", "peer", msgform.Target, "queue", msgform.TargetQName)
+		return
+	}
+	con, err := broker.nextHop(msgform.Target)
+	if err != nil {
+		broker.log(msg.LevelDebug, "No route, dropping", "peer", msgform.Target, "queue", msgform.TargetQName, "error", err)
+		return
+	}
+	if err := broker.sendPayload(con, msgform); err != nil {
+		broker.log(msg.LevelDebug, "Forwarding failed", "peer", msgform.Target, "queue", msgform.TargetQName, "error", err)
+	}
+}
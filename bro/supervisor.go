@@ -0,0 +1,214 @@
+package bro
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/msg"
+)
+
+// default interval of checking peer connections and redialing peers
+const defaultReconnectInterval = time.Second
+
+// PeerEventType tells what happened to peer
+type PeerEventType int
+
+// Peer event types
+const (
+	PeerUp PeerEventType = iota + 1
+	PeerDown
+)
+
+func (eventType PeerEventType) String() string {
+	switch eventType {
+	case PeerUp:
+		return "peer-up"
+	case PeerDown:
+		return "peer-down"
+	}
+	return "unknown"
+}
+
+// PeerEvent tells that peer broker came up or went down
+type PeerEvent struct {
+	Type   PeerEventType
+	Name   string
+	Addr   string
+	Reason string
+}
+
+// PeerEvents returns channel from which peer events can be received,
+// events are dropped if channel is full
+func (broker *Broker) PeerEvents() <-chan PeerEvent {
+	return broker.peerEvents
+}
+
+// WatchPeers registers function which is called for every peer event,
+// function is called synchronously so it should not block
+func (broker *Broker) WatchPeers(watcher func(PeerEvent)) {
+	broker.watchLock.Lock()
+	defer broker.watchLock.Unlock()
+
+	broker.watchers = append(broker.watchers, watcher)
+}
+
+func (broker *Broker) peerEvent(eventType PeerEventType, name, addr, reason string) {
+	broker.log(msg.LevelInfo, "Peer "+eventType.String(), "peer", name, "addr", addr, "reason", reason)
+
+	event := PeerEvent{
+		Type:   eventType,
+		Name:   name,
+		Addr:   addr,
+		Reason: reason,
+	}
+
+	if broker.routes != nil {
+		if eventType == PeerDown {
+			broker.routes.remove(name)
+		}
+		broker.triggerRoutes()
+	}
+
+	broker.watchLock.Lock()
+	watchers := broker.watchers
+	broker.watchLock.Unlock()
+	for _, watcher := range watchers {
+		watcher(event)
+	}
+
+	// non-blocking send
+	select {
+	case broker.peerEvents <- event:
+	default:
+	}
+}
+
+// updDown marks entries with closed connection down, returns peers which
+// went down (peer which is still up with other connection is not included)
+func (ps *PeerStore) updDown() []peerInfo {
+	ps.Lock()
+	defer ps.Unlock()
+
+	wentDown := []peerInfo{}
+	for _, v := range ps.peers {
+		if v.state == stateUp && v.conn.State() == msg.StateClosed {
+			v.state = stateDown
+			wentDown = append(wentDown, *v)
+		}
+	}
+	result := []peerInfo{}
+	reported := map[string]bool{}
+	for _, v := range wentDown {
+		if !ps.isUp(v.name) && !reported[v.name] {
+			reported[v.name] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// getRedials returns IDs and addresses of configured peers which need to be
+// connected (peers waiting for connect-ack are not included)
+func (ps *PeerStore) getRedials() map[int]string {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	result := map[int]string{}
+	for i, v := range ps.peers {
+		if v.addr == "" || v.state == stateUp {
+			continue
+		}
+		if v.conn != nil && v.conn.State() != msg.StateClosed {
+			continue
+		}
+		result[i] = v.addr
+	}
+	return result
+}
+
+func (ps *PeerStore) setConn(conID int, conn *msg.Connection) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	ps.peers[conID].conn = conn
+}
+
+// openConnection opens connection to peer, dialing is cancelled
+// when broker is closed (and limited by 'dial-timeout')
+func (broker *Broker) openConnection(addr string) (*msg.Connection, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-broker.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return broker.Server.OpenConnectionContext(ctx, addr, msg.ConnOptions{})
+}
+
+// connectPeer opens connection to peer and sends connect message,
+// peer is up when connect-ack is received
+func (broker *Broker) connectPeer(id int, addr string, failLevel msg.LogLevel) {
+	con, err := broker.openConnection(addr)
+	if err != nil {
+		broker.log(failLevel, "Connecting failed", "addr", addr, "error", err)
+		return
+	}
+	broker.Peers.setConn(id, con)
+
+	connectData := &connectMsg{
+		Name:  broker.OwnName,
+		ID:    id,
+		Addrs: broker.Addrs(),
+	}
+	conData, err := json.Marshal(connectData)
+	if err != nil {
+		broker.log(msg.LevelError, "Marshal failed", "error", err)
+		return
+	}
+	connectmsg := &msgFormat{
+		MsgName: "connect",
+		Data:    conData,
+	}
+	conMsgData, err := json.Marshal(connectmsg)
+	if err != nil {
+		broker.log(msg.LevelError, "Marshal failed", "error", err)
+		return
+	}
+	err = con.Send(string(conMsgData))
+	if err != nil {
+		broker.log(failLevel, "Initial send failed", "addr", addr, "error", err)
+		return
+	}
+}
+
+// supervisor detects peers going down and redials configured peers
+func (broker *Broker) supervisor() {
+	ticker := time.NewTicker(broker.reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-broker.stop:
+			return
+		case event := <-broker.Server.Events():
+			if event.Type == msg.EventDisconnected {
+				broker.checkDown()
+			}
+		case <-ticker.C:
+			broker.checkDown()
+			for id, addr := range broker.Peers.getRedials() {
+				broker.connectPeer(id, addr, msg.LevelDebug)
+			}
+		}
+	}
+}
+
+func (broker *Broker) checkDown() {
+	for _, peer := range broker.Peers.updDown() {
+		broker.peerEvent(PeerDown, peer.name, peer.recAddr, "connection lost")
+	}
+}
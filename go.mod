@@ -3,9 +3,12 @@ module github.com/anssihalmeaho/mzq
 go 1.17
 
 require (
-	github.com/anssihalmeaho/funl v0.0.0-20220210165841-dde9748bcbb9 // indirect
+	github.com/anssihalmeaho/funl v0.0.0-20220210165841-dde9748bcbb9
+	github.com/stretchr/testify v1.7.0
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
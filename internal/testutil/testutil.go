@@ -0,0 +1,55 @@
+// Package testutil contains helpers shared by tests of msg and bro
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// WaitFor waits until condition is true, test fails with given
+// message if condition is not true in one second
+func WaitFor(t *testing.T, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BlockTransport is transport which never connects,
+// start of dialing is signalled to Dialing channel
+type BlockTransport struct {
+	Dialing chan struct{}
+}
+
+// NewBlockTransport creates transport which signals start of
+// dialing if there's room in channel of given size
+func NewBlockTransport(size int) *BlockTransport {
+	return &BlockTransport{Dialing: make(chan struct{}, size)}
+}
+
+// Listen is not supported
+func (tr *BlockTransport) Listen(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// Dial is not supported
+func (tr *BlockTransport) Dial(addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// DialContext blocks until context is done
+func (tr *BlockTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	select {
+	case tr.Dialing <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
@@ -0,0 +1,123 @@
+package msg
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrAuthFailed is returned when peer fails in authentication
+var ErrAuthFailed = errors.New("authentication failed")
+
+// default time for completing authentication handshake
+const defaultAuthTimeout = 10 * time.Second
+
+const nonceSize = 32
+
+// Authentication handshake with pre-shared key is done when connection
+// is created, before any other frame is written or read:
+//
+//  1. both peers send random nonce (auth-nonce control frame)
+//  2. both peers send proof (auth-proof control frame) which is
+//     HMAC-SHA256(key, <own role> <nonce of peer> <own nonce>)
+//  3. both peers verify proof of the other
+//
+// Role (dialer or acceptor) in proof prevents reflection attack where
+// proof got from server in one connection is sent back to it in another.
+// Connection is closed if handshake fails or isn't completed in time.
+const (
+	ctrlAuthNonce = "auth-nonce"
+	ctrlAuthProof = "auth-proof"
+)
+
+// roles of peers in authentication
+const (
+	authDialer   = "dialer"
+	authAcceptor = "acceptor"
+)
+
+func authProof(secret, proverRole string, verifierNonce, proverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(proverRole))
+	mac.Write(verifierNonce)
+	mac.Write(proverNonce)
+	return mac.Sum(nil)
+}
+
+// writeAsync writes frame in own goroutine, so that both peers can
+// write at same time also with unbuffered connections
+func (con *Connection) writeAsync(b []byte) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := con.Conn.Write(b)
+		result <- err
+	}()
+	return result
+}
+
+// readAuthFrame reads control frame with given name and returns its payload
+func readAuthFrame(reader *bufio.Reader, name string) ([]byte, error) {
+	b, err := readFrame(reader, 2*len(name)+4*sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	f := parseFrame(b)
+	if f.control != name {
+		return nil, ErrAuthFailed
+	}
+	payload, err := hex.DecodeString(f.payload)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return payload, nil
+}
+
+// authenticate performs authentication handshake with peer
+func (con *Connection) authenticate(reader *bufio.Reader) error {
+	opt := con.ServerRef.Opt
+	timeout := opt.AuthTimeout
+	if timeout <= 0 {
+		timeout = defaultAuthTimeout
+	}
+	con.Conn.SetDeadline(time.Now().Add(timeout))
+	defer con.Conn.SetDeadline(time.Time{})
+
+	ownNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(ownNonce); err != nil {
+		return err
+	}
+	written := con.writeAsync(controlFrame(ctrlAuthNonce, hex.EncodeToString(ownNonce)))
+	peerNonce, err := readAuthFrame(reader, ctrlAuthNonce)
+	if err != nil {
+		return err
+	}
+	if err := <-written; err != nil {
+		return err
+	}
+	// reflected nonce would make proofs equal
+	if len(peerNonce) != nonceSize || hmac.Equal(peerNonce, ownNonce) {
+		return ErrAuthFailed
+	}
+
+	ownRole, peerRole := authDialer, authAcceptor
+	if con.accepted {
+		ownRole, peerRole = authAcceptor, authDialer
+	}
+	proof := authProof(opt.SharedSecret, ownRole, peerNonce, ownNonce)
+	written = con.writeAsync(controlFrame(ctrlAuthProof, hex.EncodeToString(proof)))
+	peerProof, err := readAuthFrame(reader, ctrlAuthProof)
+	if err != nil {
+		return err
+	}
+	if err := <-written; err != nil {
+		return err
+	}
+	if !hmac.Equal(peerProof, authProof(opt.SharedSecret, peerRole, ownNonce, peerNonce)) {
+		return ErrAuthFailed
+	}
+	return nil
+}
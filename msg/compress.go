@@ -0,0 +1,196 @@
+package msg
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Compression is negotiated with hello control frames: peer which offers
+// compression sends hello with codecs it supports when connecting and
+// peer receiving hello answers with own hello (if not sent already).
+// Messages are compressed only towards peers which have told to
+// support compression. Hello is sent only when connecting to peers for
+// which compression is enabled explicitly (CompressionPeers or
+// ConnOptions.Compression) and as answer to hello, so peers of older
+// versions (without control frames) never receive it. Data starting with
+// control prefix is escaped only towards peers which have sent hello
+// (older peers get data unchanged).
+
+const codecDeflate = "deflate"
+
+// default minimum size of message data to be compressed
+const defaultCompressionThreshold = 256
+
+// compressed data is escaped so that it does not contain zero bytes
+const (
+	escByte     = 2
+	escZero     = 3
+	escEscByte  = 2
+	escapeExtra = 16
+)
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func escapeBytes(b []byte) []byte {
+	result := make([]byte, 0, len(b)+escapeExtra)
+	for _, c := range b {
+		switch c {
+		case 0:
+			result = append(result, escByte, escZero)
+		case escByte:
+			result = append(result, escByte, escEscByte)
+		default:
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func unescapeBytes(b []byte) []byte {
+	result := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == escByte && i+1 < len(b) {
+			i++
+			if b[i] == escZero {
+				result = append(result, 0)
+				continue
+			}
+		}
+		result = append(result, b[i])
+	}
+	return result
+}
+
+func compressData(data string) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	w.Write([]byte(data))
+	w.Close()
+	return escapeBytes(buf.Bytes())
+}
+
+// decompressData decompresses data which is at most maxSize bytes (0 = no limit)
+func decompressData(payload string, maxSize int) (string, error) {
+	r := flate.NewReader(bytes.NewReader(unescapeBytes([]byte(payload))))
+	defer r.Close()
+
+	var reader io.Reader = r
+	if maxSize > 0 {
+		reader = io.LimitReader(r, int64(maxSize)+1)
+	}
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	if maxSize > 0 && len(b) > maxSize {
+		return "", ErrFrameTooLarge
+	}
+	return string(b), nil
+}
+
+// decodeFrame decompresses frame if it's compressed,
+// maxSize limits size of decompressed data (0 = no limit)
+func decodeFrame(f frame, maxSize int) (frame, error) {
+	if f.control != ctrlCompressed {
+		return f, nil
+	}
+	data, err := decompressData(f.payload, maxSize)
+	if err != nil {
+		return f, fmt.Errorf("decompress failed: %v", err)
+	}
+	return frame{data: data}, nil
+}
+
+func (con *Connection) sendHello() {
+	con.lock.Lock()
+	if con.helloSent {
+		con.lock.Unlock()
+		return
+	}
+	con.helloSent = true
+	con.lock.Unlock()
+
+	con.enqueue(controlFrame(ctrlHello, codecDeflate), false)
+}
+
+func (con *Connection) handleHello(payload string) {
+	con.lock.Lock()
+	con.peerHello = true
+	for _, codec := range strings.Split(payload, ",") {
+		if codec == codecDeflate {
+			con.peerDeflate = true
+		}
+	}
+	con.lock.Unlock()
+
+	con.sendHello()
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (con *Connection) useCompression(data string) bool {
+	opt := con.ServerRef.Opt
+	if !con.compress {
+		return false
+	}
+	threshold := opt.CompressionThreshold
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	if len(data) < threshold {
+		return false
+	}
+
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	return con.peerDeflate
+}
+
+// escapesData returns true if peer understands control frames
+// (so that data starting with control prefix is escaped)
+func (con *Connection) escapesData() bool {
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	return con.peerHello
+}
+
+// encodeData makes frame for data, compressed if it's useful, data
+// inside other frame (like request) is always escaped
+func (con *Connection) encodeData(data string, inner bool) []byte {
+	if !con.useCompression(data) {
+		return dataFrame(data, inner || con.escapesData())
+	}
+	compressed := compressData(data)
+	if len(compressed) >= len(data) {
+		return dataFrame(data, inner || con.escapesData())
+	}
+
+	con.lock.Lock()
+	con.stats.CompressedMessages++
+	con.stats.UncompressedBytes += len(data)
+	con.stats.CompressedBytes += len(compressed)
+	con.lock.Unlock()
+
+	return controlFrame(ctrlCompressed, string(compressed))
+}
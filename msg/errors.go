@@ -0,0 +1,55 @@
+package msg
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ErrUnknownScheme is returned when address has unknown scheme
+var ErrUnknownScheme = errors.New("unknown address scheme")
+
+// Error codes tell kind of failure (to FunL programs), errors
+// which aren't recognized have code CodeError
+const (
+	CodeTimeout          = "timeout"
+	CodeConnectionClosed = "connection-closed"
+	CodeServerClosed     = "server-closed"
+	CodeNotConnected     = "not-connected"
+	CodeOutboxFull       = "outbox-full"
+	CodeFrameTooLarge    = "frame-too-large"
+	CodeNotRequest       = "not-request"
+	CodeAuthFailed       = "auth-failed"
+	CodeUnknownScheme    = "unknown-scheme"
+	CodeError            = "error"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrTimeout, CodeTimeout},
+	{os.ErrDeadlineExceeded, CodeTimeout},
+	{ErrConnectionClosed, CodeConnectionClosed},
+	{net.ErrClosed, CodeConnectionClosed},
+	{ErrServerClosed, CodeServerClosed},
+	{ErrNotConnected, CodeNotConnected},
+	{ErrOutboxFull, CodeOutboxFull},
+	{ErrFrameTooLarge, CodeFrameTooLarge},
+	{ErrNotRequest, CodeNotRequest},
+	{ErrAuthFailed, CodeAuthFailed},
+	{ErrUnknownScheme, CodeUnknownScheme},
+}
+
+// ErrorCode returns error code of error (empty string for nil)
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return CodeError
+}
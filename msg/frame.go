@@ -0,0 +1,82 @@
+package msg
+
+import (
+	"strings"
+)
+
+// Frames are separated by zero byte. Frame starting with controlPrefix
+// and known control name is control frame (like heartbeat) which is
+// handled inside msg package and not delivered to receiver. Data starting
+// with controlPrefix is escaped by doubling the prefix (only towards peers
+// which understand control frames, see compress.go).
+const controlPrefix = 1
+
+// control frame names
+const (
+	ctrlPing       = "ping"
+	ctrlPong       = "pong"
+	ctrlHello      = "hello"
+	ctrlCompressed = "z"
+	ctrlRequest    = "req"
+	ctrlReply      = "rep"
+)
+
+var controlNames = map[string]bool{
+	ctrlPing:       true,
+	ctrlPong:       true,
+	ctrlHello:      true,
+	ctrlCompressed: true,
+	ctrlRequest:    true,
+	ctrlReply:      true,
+	ctrlAuthNonce:  true,
+	ctrlAuthProof:  true,
+}
+
+// frame is received frame
+type frame struct {
+	data    string
+	control string
+	payload string
+}
+
+func (f frame) isControl() bool {
+	return f.control != ""
+}
+
+func dataFrame(data string, escape bool) []byte {
+	b := make([]byte, 0, len(data)+2)
+	if escape && len(data) > 0 && data[0] == controlPrefix {
+		b = append(b, controlPrefix)
+	}
+	b = append(b, data...)
+	return append(b, 0)
+}
+
+// controlFrame makes control frame, format is: <prefix><name>:<payload>
+func controlFrame(name, payload string) []byte {
+	b := make([]byte, 0, len(name)+len(payload)+3)
+	b = append(b, controlPrefix)
+	b = append(b, name...)
+	b = append(b, ':')
+	b = append(b, payload...)
+	return append(b, 0)
+}
+
+// parseFrame parses frame read from connection (including delimiter)
+func parseFrame(b []byte) frame {
+	b = b[:len(b)-1]
+	if len(b) == 0 || b[0] != controlPrefix {
+		return frame{data: string(b)}
+	}
+	if len(b) > 1 && b[1] == controlPrefix {
+		return frame{data: string(b[1:])}
+	}
+	parts := strings.SplitN(string(b[1:]), ":", 2)
+	if len(parts) != 2 || !controlNames[parts[0]] {
+		// unescaped data (from older peer)
+		return frame{data: string(b)}
+	}
+	f := frame{control: parts[0]}
+	f.payload = parts[1]
+	return f
+}
@@ -0,0 +1,50 @@
+package msg
+
+import (
+	"time"
+)
+
+// default amount of heartbeat intervals without any frame from peer
+// after which connection is considered dead
+const defaultHeartbeatMisses = 3
+
+func (con *Connection) touch() {
+	con.lock.Lock()
+	defer con.lock.Unlock()
+
+	con.lastReceived = time.Now()
+}
+
+func (con *Connection) sinceReceived() time.Duration {
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	return time.Since(con.lastReceived)
+}
+
+// heartbeat sends ping to peer periodically and closes
+// connection if nothing is received from peer in time
+// (peers of older versions don't answer to ping)
+func (con *Connection) heartbeat(interval time.Duration, misses int) {
+	if misses <= 0 {
+		misses = defaultHeartbeatMisses
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-con.done:
+			return
+		case <-ticker.C:
+			if con.sinceReceived() > interval*time.Duration(misses) {
+				con.ServerRef.Log(LevelWarn, "Closing connection", "addr", con.addr, "reason", "heartbeat timeout")
+				con.ServerRef.sendEvent(EventError, con.addr, "heartbeat timeout")
+				con.closeWithReason("heartbeat timeout")
+				return
+			}
+			// write errors are handled by writer
+			con.enqueue(controlFrame(ctrlPing, ""), false)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package msg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrFrameTooLarge is returned when frame exceeds maximum frame size
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ServerStats contains statistics of messaging server
+type ServerStats struct {
+	Connections         int
+	AcceptedConnections int
+	RejectedConnections int
+	OversizedFrames     int
+
+	// delays caused by rate limits (in all connections)
+	SendThrottle ThrottleStats
+	RecvThrottle ThrottleStats
+}
+
+// tokenBucket is rate limiter which allows given rate (per second)
+// with bursts of given size
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds tokens for time passed, needs to be called with lock
+func (tb *tokenBucket) refill() {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// allow takes n tokens if there are enough tokens
+func (tb *tokenBucket) allow(n float64) bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill()
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// reserve takes n tokens and returns time to wait until they are
+// available (tokens can be taken in advance so requests larger than
+// burst are allowed too)
+func (tb *tokenBucket) reserve(n float64) time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill()
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// readFrame reads frame (until zero byte) which is at most maxSize bytes
+// (without delimiter), zero maxSize means no limit
+func readFrame(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := reader.ReadSlice(0)
+		if maxSize > 0 && len(frame)+len(chunk) > maxSize+1 {
+			return nil, ErrFrameTooLarge
+		}
+		frame = append(frame, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return frame, err
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	switch conn.RemoteAddr().(type) {
+	case *net.TCPAddr, *net.UDPAddr:
+	default:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// admit checks if accepted connection is allowed by limits,
+// returns reason if not allowed
+func (server *MessageServer) admit(conn net.Conn) (ip string, reason string) {
+	if server.acceptLimiter != nil && !server.acceptLimiter.allow(1) {
+		reason = "accept rate exceeded"
+	}
+	ip = remoteIP(conn)
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if reason == "" && server.Opt.MaxConnections > 0 && server.acceptedConns >= server.Opt.MaxConnections {
+		reason = fmt.Sprintf("too many connections (%d)", server.acceptedConns)
+	}
+	if reason == "" && ip != "" && server.Opt.MaxConnsPerIP > 0 && server.ipConns[ip] >= server.Opt.MaxConnsPerIP {
+		reason = fmt.Sprintf("too many connections from %s (%d)", ip, server.ipConns[ip])
+	}
+	if reason != "" {
+		server.stats.RejectedConnections++
+		return
+	}
+	server.acceptedConns++
+	server.stats.AcceptedConnections++
+	if ip != "" {
+		server.ipConns[ip]++
+	}
+	return
+}
+
+// release releases accepted connection from limits
+func (server *MessageServer) release(ip string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.acceptedConns--
+	if ip != "" {
+		server.ipConns[ip]--
+		if server.ipConns[ip] <= 0 {
+			delete(server.ipConns, ip)
+		}
+	}
+}
+
+func (server *MessageServer) addOversized() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.stats.OversizedFrames++
+}
+
+// Stats returns statistics of server
+func (server *MessageServer) Stats() ServerStats {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+
+	stats := server.stats
+	stats.Connections = len(server.Conns)
+	return stats
+}
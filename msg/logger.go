@@ -0,0 +1,157 @@
+package msg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is severity of log record
+type LogLevel int
+
+// Log levels (same values as in log/slog)
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(level))
+}
+
+// ParseLogLevel parses level name (debug, info, warn, error)
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level (%s)", name)
+}
+
+// Logger receives log records, fields are given as key-value pairs
+// (like "addr", "tcp://127.0.0.1:8000")
+type Logger interface {
+	Log(level LogLevel, message string, fields ...interface{})
+}
+
+// LoggerFunc is function which can be used as Logger
+type LoggerFunc func(level LogLevel, message string, fields ...interface{})
+
+// Log calls function
+func (f LoggerFunc) Log(level LogLevel, message string, fields ...interface{}) {
+	f(level, message, fields...)
+}
+
+// TextLogger writes log records as lines of key=value pairs
+// (in same format as log/slog TextHandler)
+type TextLogger struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// NewTextLogger creates logger writing to given writer
+func NewTextLogger(w io.Writer) *TextLogger {
+	return &TextLogger{w: w}
+}
+
+// DefaultLogger is used if logger is not given in options, then only
+// warnings and errors are logged (unless level is given in options map)
+var DefaultLogger Logger = NewTextLogger(os.Stderr)
+
+// minimum level of records logged with DefaultLogger if logger is not given
+const defaultLoggerLevel = LevelWarn
+
+// Log writes log record
+func (tl *TextLogger) Log(level LogLevel, message string, fields ...interface{}) {
+	var sb strings.Builder
+	sb.WriteString("time=")
+	sb.WriteString(time.Now().Format(time.RFC3339Nano))
+	sb.WriteString(" level=")
+	sb.WriteString(level.String())
+	sb.WriteString(" msg=")
+	sb.WriteString(quoteLogValue(message))
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldPair(fields, i)
+		sb.WriteString(" ")
+		sb.WriteString(quoteLogValue(key))
+		sb.WriteString("=")
+		sb.WriteString(quoteLogValue(value))
+	}
+	sb.WriteString("\n")
+
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	io.WriteString(tl.w, sb.String())
+}
+
+// fieldPair returns key and value (as strings) starting from index i
+func fieldPair(fields []interface{}, i int) (string, string) {
+	if i+1 >= len(fields) {
+		return "!BADKEY", fmt.Sprint(fields[i])
+	}
+	return fmt.Sprint(fields[i]), fmt.Sprint(fields[i+1])
+}
+
+// LogFields converts key-value pairs to map
+func LogFields(fields ...interface{}) map[string]string {
+	result := map[string]string{}
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldPair(fields, i)
+		result[key] = value
+	}
+	return result
+}
+
+func quoteLogValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, c := range s {
+		if c <= ' ' || c == '=' || c == '"' || !strconv.IsPrint(c) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// logger returns logger of server and minimum level of logged records
+func (server *MessageServer) logger() (Logger, LogLevel) {
+	if server.Opt.Logger == nil {
+		if server.Opt.LogLevel < defaultLoggerLevel {
+			return DefaultLogger, defaultLoggerLevel
+		}
+		return DefaultLogger, server.Opt.LogLevel
+	}
+	return server.Opt.Logger, server.Opt.LogLevel
+}
+
+// Log logs record with logger of server if level is enabled
+func (server *MessageServer) Log(level LogLevel, message string, fields ...interface{}) {
+	logger, minLevel := server.logger()
+	if level < minLevel {
+		return
+	}
+	logger.Log(level, message, fields...)
+}
@@ -0,0 +1,110 @@
+package msg
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// memTransport is in-memory transport for connections inside one process,
+// addresses are like "mem://name"
+type memTransport struct {
+	listeners map[string]*memListener
+	lock      sync.Mutex
+}
+
+func newMemTransport() *memTransport {
+	return &memTransport{listeners: map[string]*memListener{}}
+}
+
+type memAddr string
+
+func (addr memAddr) Network() string {
+	return "mem"
+}
+
+func (addr memAddr) String() string {
+	return string(addr)
+}
+
+// memConn is one end of in-memory pipe with own addresses
+type memConn struct {
+	net.Conn
+	local  memAddr
+	remote memAddr
+}
+
+func (conn *memConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *memConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+type memListener struct {
+	name      string
+	transport *memTransport
+	connCh    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.connCh:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.closeOnce.Do(func() {
+		ln.transport.lock.Lock()
+		defer ln.transport.lock.Unlock()
+
+		delete(ln.transport.listeners, ln.name)
+		close(ln.done)
+	})
+	return nil
+}
+
+func (ln *memListener) Addr() net.Addr {
+	return memAddr(ln.name)
+}
+
+func (tr *memTransport) Listen(addr string) (net.Listener, error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	if _, found := tr.listeners[addr]; found {
+		return nil, fmt.Errorf("Address already in use (mem://%s)", addr)
+	}
+	ln := &memListener{
+		name:      addr,
+		transport: tr,
+		connCh:    make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	tr.listeners[addr] = ln
+	return ln, nil
+}
+
+func (tr *memTransport) Dial(addr string) (net.Conn, error) {
+	tr.lock.Lock()
+	ln, found := tr.listeners[addr]
+	tr.lock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("Connection refused (mem://%s)", addr)
+	}
+
+	// dialing side is unnamed, like unix socket client
+	serverEnd, clientEnd := net.Pipe()
+	select {
+	case ln.connCh <- &memConn{Conn: serverEnd, local: memAddr(addr)}:
+	case <-ln.done:
+		return nil, fmt.Errorf("Connection refused (mem://%s)", addr)
+	}
+	return &memConn{Conn: clientEnd, remote: memAddr(addr)}, nil
+}
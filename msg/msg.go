@@ -2,32 +2,389 @@ package msg
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
-// MessageServer represents messaging server
+// ErrTimeout is returned when receiving times out
+var ErrTimeout = errors.New("receive timeout")
+
+// ErrConnectionClosed is returned when receiving from closed connection
+var ErrConnectionClosed = errors.New("connection closed")
+
+// ErrServerClosed is returned when using closed server
+var ErrServerClosed = errors.New("server closed")
+
+// maximum delay before accepting again after accept error
+const maxAcceptDelay = time.Second
+
+// MessageServer represents messaging server,
+// Listener is listener of Opt.Addr
 type MessageServer struct {
-	Opt      Options
-	Listener net.Listener
-	Conns    map[string]net.Conn
-	lock     sync.RWMutex
-	recChan  chan Msg
+	Opt       Options
+	Listener  net.Listener
+	Conns     map[string]*Connection
+	lock      sync.RWMutex
+	recChan   chan Msg
+	eventCh   chan Event
+	listeners []listener
+	connSeq   int
+	done      chan struct{}
+	closed    bool
+
+	stats         ServerStats
+	acceptedConns int
+	ipConns       map[string]int
+	acceptLimiter *tokenBucket
+	sendLimiter   *rateLimiter
+	recvLimiter   *rateLimiter
+}
+
+// EventType tells what happened to connection
+type EventType int
+
+// Connection event types
+const (
+	EventConnected EventType = iota + 1
+	EventDisconnected
+	EventError
+)
+
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Event represents connection lifecycle event,
+// Addr is same as FromAddr in messages from connection
+type Event struct {
+	Type   EventType
+	Addr   string
+	Reason string
 }
 
 // Options contains options for messaging server
 type Options struct {
+	// Addr is listening address, with optional scheme
+	// (like ":8081", "tcp://:8081" or "unix:///run/app.sock")
 	Addr string
+
+	// HeartbeatInterval is interval of sending heartbeats to peer (0 = no heartbeats),
+	// connection is closed if nothing is received from peer during
+	// HeartbeatMisses intervals (default 3)
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+
+	// ReadTimeout closes connection if nothing is received in given time (0 = no timeout)
+	ReadTimeout time.Duration
+
+	// WriteTimeout is deadline for writing one message (0 = no timeout)
+	WriteTimeout time.Duration
+
+	// DialTimeout limits time of opening connection (default 10 seconds)
+	DialTimeout time.Duration
+
+	// OutboxSize is amount of messages which can wait for writing
+	// in connection (default 100)
+	OutboxSize int
+
+	// Compression enables compression of messages which are at least
+	// CompressionThreshold bytes (default 256) towards peers supporting it,
+	// compression is offered when connecting to CompressionPeers (peers
+	// which don't offer compression themselves get uncompressed messages)
+	Compression          bool
+	CompressionThreshold int
+	CompressionPeers     []string
+
+	// MaxFrameSize is maximum size of received frame in bytes,
+	// connection sending bigger frame is closed (0 = no limit)
+	MaxFrameSize int
+
+	// MaxConnections and MaxConnsPerIP limit amount of accepted
+	// connections (0 = no limit)
+	MaxConnections int
+	MaxConnsPerIP  int
+
+	// AcceptRate limits accepted connections per second with
+	// bursts of AcceptBurst connections (0 = no limit)
+	AcceptRate  float64
+	AcceptBurst int
+
+	// SharedSecret enables authentication handshake with pre-shared key
+	// for every connection, handshake needs to be completed in AuthTimeout
+	// (default 10s)
+	SharedSecret string
+	AuthTimeout  time.Duration
+
+	// Logger receives log records with level LogLevel or higher
+	// (if not given DefaultLogger is used for records with level LevelWarn
+	// or higher, so info records need to be enabled by giving Logger)
+	Logger   Logger
+	LogLevel LogLevel
+
+	// Datagram makes addresses without scheme to use UDP transport
+	// ("udp://" addresses use it always), DatagramSequence adds
+	// sequence numbers to sent datagrams for loss detection and
+	// MaxDatagramSize limits size of sent datagrams (default 65507),
+	// accepted datagram connections from which nothing is received during
+	// DatagramIdleTimeout (default 5 minutes) are closed and datagrams from
+	// new addresses are dropped if there are already MaxDatagramConns
+	// (default 1024) accepted datagram connections
+	Datagram            bool
+	DatagramSequence    bool
+	MaxDatagramSize     int
+	DatagramIdleTimeout time.Duration
+	MaxDatagramConns    int
+
+	// ListenAddrs are listened in addition to Addr
+	ListenAddrs []string
+
+	// SendLimit and RecvLimit limit traffic of each connection and
+	// ServerSendLimit and ServerRecvLimit total traffic of server,
+	// traffic exceeding limits is delayed
+	SendLimit       RateLimit
+	RecvLimit       RateLimit
+	ServerSendLimit RateLimit
+	ServerRecvLimit RateLimit
 }
 
-func (server *MessageServer) addConn(conn net.Conn) {
+// SetFromMap sets options from name-value map (like FunL options map)
+func (opt *Options) SetFromMap(options map[string]interface{}) error {
+	var err error
+	if opt.HeartbeatInterval, err = durationOption(options, "heartbeat-interval", opt.HeartbeatInterval); err != nil {
+		return err
+	}
+	if opt.HeartbeatMisses, err = intOption(options, "heartbeat-misses", opt.HeartbeatMisses); err != nil {
+		return err
+	}
+	if opt.ReadTimeout, err = durationOption(options, "read-timeout", opt.ReadTimeout); err != nil {
+		return err
+	}
+	if opt.WriteTimeout, err = durationOption(options, "write-timeout", opt.WriteTimeout); err != nil {
+		return err
+	}
+	if opt.DialTimeout, err = durationOption(options, "dial-timeout", opt.DialTimeout); err != nil {
+		return err
+	}
+	if opt.OutboxSize, err = intOption(options, "outbox-size", opt.OutboxSize); err != nil {
+		return err
+	}
+	if opt.Compression, err = boolOption(options, "compression", opt.Compression); err != nil {
+		return err
+	}
+	if opt.CompressionThreshold, err = intOption(options, "compression-threshold", opt.CompressionThreshold); err != nil {
+		return err
+	}
+	if opt.CompressionPeers, err = stringListOption(options, "compression-peers", opt.CompressionPeers); err != nil {
+		return err
+	}
+	if opt.MaxFrameSize, err = intOption(options, "max-frame-size", opt.MaxFrameSize); err != nil {
+		return err
+	}
+	if opt.MaxConnections, err = intOption(options, "max-connections", opt.MaxConnections); err != nil {
+		return err
+	}
+	if opt.MaxConnsPerIP, err = intOption(options, "max-conns-per-ip", opt.MaxConnsPerIP); err != nil {
+		return err
+	}
+	if opt.AcceptRate, err = floatOption(options, "accept-rate", opt.AcceptRate); err != nil {
+		return err
+	}
+	if opt.AcceptBurst, err = intOption(options, "accept-burst", opt.AcceptBurst); err != nil {
+		return err
+	}
+	if opt.SharedSecret, err = stringOption(options, "shared-secret", opt.SharedSecret); err != nil {
+		return err
+	}
+	if opt.AuthTimeout, err = durationOption(options, "auth-timeout", opt.AuthTimeout); err != nil {
+		return err
+	}
+	if opt.Datagram, err = boolOption(options, "datagram", opt.Datagram); err != nil {
+		return err
+	}
+	if opt.DatagramSequence, err = boolOption(options, "datagram-sequence", opt.DatagramSequence); err != nil {
+		return err
+	}
+	if opt.MaxDatagramSize, err = intOption(options, "max-datagram-size", opt.MaxDatagramSize); err != nil {
+		return err
+	}
+	if opt.DatagramIdleTimeout, err = durationOption(options, "datagram-idle-timeout", opt.DatagramIdleTimeout); err != nil {
+		return err
+	}
+	if opt.MaxDatagramConns, err = intOption(options, "max-datagram-conns", opt.MaxDatagramConns); err != nil {
+		return err
+	}
+	if opt.ListenAddrs, err = stringListOption(options, "listen-addrs", opt.ListenAddrs); err != nil {
+		return err
+	}
+	if opt.SendLimit, err = rateLimitOption(options, "send-", opt.SendLimit); err != nil {
+		return err
+	}
+	if opt.RecvLimit, err = rateLimitOption(options, "recv-", opt.RecvLimit); err != nil {
+		return err
+	}
+	if opt.ServerSendLimit, err = rateLimitOption(options, "server-send-", opt.ServerSendLimit); err != nil {
+		return err
+	}
+	if opt.ServerRecvLimit, err = rateLimitOption(options, "server-recv-", opt.ServerRecvLimit); err != nil {
+		return err
+	}
+	if v, found := options["logger"]; found {
+		logger, ok := v.(Logger)
+		if !ok {
+			return fmt.Errorf("Invalid format for logger")
+		}
+		opt.Logger = logger
+	}
+	if v, found := options["log-level"]; found {
+		levelName, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("Invalid format for log-level (string needed)")
+		}
+		if opt.LogLevel, err = ParseLogLevel(levelName); err != nil {
+			return err
+		}
+		if opt.Logger == nil {
+			// level given explicitly is used also with default logger
+			opt.Logger = DefaultLogger
+		}
+	}
+	return nil
+}
+
+func intOption(options map[string]interface{}, name string, defaultValue int) (int, error) {
+	v, found := options[name]
+	if !found {
+		return defaultValue, nil
+	}
+	intVal, ok := v.(int)
+	if !ok {
+		return defaultValue, fmt.Errorf("Invalid format for %s (int needed)", name)
+	}
+	return intVal, nil
+}
+
+func stringOption(options map[string]interface{}, name string, defaultValue string) (string, error) {
+	v, found := options[name]
+	if !found {
+		return defaultValue, nil
+	}
+	stringVal, ok := v.(string)
+	if !ok {
+		return defaultValue, fmt.Errorf("Invalid format for %s (string needed)", name)
+	}
+	return stringVal, nil
+}
+
+func stringListOption(options map[string]interface{}, name string, defaultValue []string) ([]string, error) {
+	v, found := options[name]
+	if !found {
+		return defaultValue, nil
+	}
+	listVal, ok := v.([]string)
+	if !ok {
+		return defaultValue, fmt.Errorf("Invalid format for %s (list of strings needed)", name)
+	}
+	return listVal, nil
+}
+
+func boolOption(options map[string]interface{}, name string, defaultValue bool) (bool, error) {
+	v, found := options[name]
+	if !found {
+		return defaultValue, nil
+	}
+	boolVal, ok := v.(bool)
+	if !ok {
+		return defaultValue, fmt.Errorf("Invalid format for %s (bool needed)", name)
+	}
+	return boolVal, nil
+}
+
+func floatOption(options map[string]interface{}, name string, defaultValue float64) (float64, error) {
+	v, found := options[name]
+	if !found {
+		return defaultValue, nil
+	}
+	switch val := v.(type) {
+	case float64:
+		return val, nil
+	case int:
+		return float64(val), nil
+	}
+	return defaultValue, fmt.Errorf("Invalid format for %s (number needed)", name)
+}
+
+func durationOption(options map[string]interface{}, name string, defaultValue time.Duration) (time.Duration, error) {
+	intVal, err := intOption(options, name, int(defaultValue))
+	return time.Duration(intVal), err
+}
+
+// newConnection creates connection and adds it to server
+func (server *MessageServer) newConnection(scheme string, conn net.Conn) *Connection {
+	outboxSize := server.Opt.OutboxSize
+	if outboxSize <= 0 {
+		outboxSize = defaultOutboxSize
+	}
+	connection := &Connection{
+		Conn:              conn,
+		ServerRef:         server,
+		recChan:           make(chan Msg, 10),
+		done:              make(chan struct{}),
+		outbox:            make(chan outItem, outboxSize),
+		calls:             map[string]chan string{},
+		lastReceived:      time.Now(),
+		heartbeatInterval: server.Opt.HeartbeatInterval,
+		compress:          server.Opt.Compression,
+		heartbeatMisses:   server.Opt.HeartbeatMisses,
+		sendLimiter:       newRateLimiter(server.Opt.SendLimit),
+		recvLimiter:       newRateLimiter(server.Opt.RecvLimit),
+	}
+	if dc, isDatagram := conn.(*udpConn); isDatagram {
+		connection.datagram = true
+		dc.sequence = server.Opt.DatagramSequence
+	}
+	server.addConn(scheme, connection)
+	return connection
+}
+
+// addConn adds connection with address which identifies it in server,
+// TCP connections are identified by remote address (without scheme)
+// and others with scheme and remote address (or sequence number
+// if remote address is unnamed, like with unix socket clients)
+func (server *MessageServer) addConn(scheme string, connection *Connection) {
 	server.lock.Lock()
 	defer server.lock.Unlock()
 
-	server.Conns[conn.RemoteAddr().String()] = conn
+	remoteAddr := connection.Conn.RemoteAddr().String()
+	switch {
+	case scheme == DefaultScheme:
+		connection.addr = remoteAddr
+	case remoteAddr == "" || remoteAddr == "@":
+		server.connSeq++
+		connection.addr = fmt.Sprintf("%s://@%d", scheme, server.connSeq)
+	default:
+		connection.addr = scheme + "://" + remoteAddr
+	}
+	server.Conns[connection.addr] = connection
+
+	// connection created while closing server is closed right away
+	// (receiver of connection cleans it up)
+	if server.closed {
+		connection.closeWithReason(ErrServerClosed.Error())
+	}
 }
 
 func (server *MessageServer) removeConn(addr string) {
@@ -37,120 +394,612 @@ func (server *MessageServer) removeConn(addr string) {
 	delete(server.Conns, addr)
 }
 
-func (server *MessageServer) getConn(addr string) (net.Conn, bool) {
+func (server *MessageServer) getConn(addr string) (*Connection, bool) {
 	server.lock.RLock()
 	defer server.lock.RUnlock()
 
-	conn, found := server.Conns[addr]
-	return conn, found
+	connection, found := server.Conns[addr]
+	return connection, found
+}
+
+func (server *MessageServer) sendEvent(eventType EventType, addr, reason string) {
+	event := Event{
+		Type:   eventType,
+		Addr:   addr,
+		Reason: reason,
+	}
+	if eventType != EventError {
+		server.Log(LevelDebug, "Connection "+eventType.String(), "addr", addr, "reason", reason)
+	}
+
+	// non-blocking send
+	select {
+	case server.eventCh <- event:
+	default:
+	}
 }
 
-func (server *MessageServer) receiver(conn net.Conn) {
-	server.addConn(conn)
-	remoteAddr := conn.RemoteAddr().String()
-	defer server.removeConn(remoteAddr)
+func (server *MessageServer) receiver(connection *Connection) {
+	remoteAddr := connection.addr
+	reason := "closed"
+	defer func() {
+		server.removeConn(remoteAddr)
+		if connection.accepted {
+			server.release(connection.ip)
+		}
+		connection.Conn.Close()
+		// connection closed by peer is marked closed too so that
+		// nothing is enqueued after writer has stopped
+		connection.lock.Lock()
+		connection.closed = true
+		connection.lock.Unlock()
+		close(connection.done)
+		if closeReason := connection.getCloseReason(); closeReason != "" {
+			reason = closeReason
+		}
+		server.sendEvent(EventDisconnected, remoteAddr, reason)
+	}()
+
+	reader := bufio.NewReader(connection.Conn)
+	if server.Opt.SharedSecret != "" {
+		if err := connection.authenticate(reader); err != nil {
+			authReason := ErrAuthFailed.Error()
+			if err != ErrAuthFailed {
+				authReason = fmt.Sprintf("%v (%v)", ErrAuthFailed, err)
+			}
+			server.Log(LevelWarn, "Closing connection", "addr", remoteAddr, "reason", authReason)
+			server.sendEvent(EventError, remoteAddr, authReason)
+			connection.closeWithReason(authReason)
+
+			// writer is not started, messages queued meanwhile are failed
+			go func() {
+				<-connection.done
+				connection.drainOutbox()
+			}()
+			return
+		}
+	}
+
+	go connection.writer()
+	if connection.offerHello {
+		connection.sendHello()
+	}
+	if connection.heartbeatInterval > 0 {
+		go connection.heartbeat(connection.heartbeatInterval, connection.heartbeatMisses)
+	}
 
 	for {
-		recData, err := bufio.NewReader(conn).ReadBytes(0)
-		if errors.Is(err, net.ErrClosed) {
+		if server.Opt.ReadTimeout > 0 {
+			connection.Conn.SetReadDeadline(time.Now().Add(server.Opt.ReadTimeout))
+		}
+		recData, err := readFrame(reader, server.Opt.MaxFrameSize)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
 			break
 		}
+		if err == ErrFrameTooLarge {
+			reason = fmt.Sprintf("frame too large (max %d bytes)", server.Opt.MaxFrameSize)
+			server.Log(LevelWarn, "Closing connection", "addr", remoteAddr, "reason", reason)
+			server.addOversized()
+			server.sendEvent(EventError, remoteAddr, reason)
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			reason = "read timeout"
+			server.sendEvent(EventError, remoteAddr, reason)
+			return
+		}
 		if err == io.EOF {
+			reason = "closed by peer"
 			break
 		}
 		if err != nil {
-			fmt.Println(fmt.Sprintf("Error in reading: %v", err))
+			server.Log(LevelError, "Error in reading", "addr", remoteAddr, "error", err)
+			reason = err.Error()
+			server.sendEvent(EventError, remoteAddr, reason)
 			return
 		}
+		connection.touch()
+		if !connection.throttleRecv(len(recData)) {
+			break
+		}
+
+		f, err := decodeFrame(parseFrame(recData), server.Opt.MaxFrameSize)
+		if err != nil {
+			server.sendEvent(EventError, remoteAddr, err.Error())
+			continue
+		}
+		var callID string
+		switch f.control {
+		case "":
+		case ctrlRequest:
+			if callID, f, err = splitTagged(f.payload, server.Opt.MaxFrameSize); err != nil {
+				server.sendEvent(EventError, remoteAddr, err.Error())
+				continue
+			}
+		default:
+			connection.handleControl(f)
+			continue
+		}
 		msg := Msg{
 			FromAddr: remoteAddr,
-			Data:     string(recData[:len(recData)-1]),
+			Data:     f.data,
+			CallID:   callID,
+		}
+
+		recChan := server.recChan
+		if connection.isDirect() {
+			recChan = connection.recChan
 		}
 
 		// non-blocking send
 		select {
-		case server.recChan <- msg:
+		case recChan <- msg:
 		default:
 		}
 	}
 }
 
-func (server *MessageServer) acceptor() {
+// listener is one listening address of server
+type listener struct {
+	net.Listener
+	scheme string
+}
+
+func (server *MessageServer) acceptor(ln listener) {
+	var delay time.Duration
 	for {
-		conn, err := server.Listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			panic(err)
+			if server.isClosed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// temporary error (like too many open files), retry after delay
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			server.Log(LevelError, "Accept failed", "addr", ln.Addr(), "error", err, "retry", delay)
+			select {
+			case <-time.After(delay):
+			case <-server.done:
+				return
+			}
+			continue
 		}
-		go server.receiver(conn)
+		delay = 0
+		ip, reason := server.admit(conn)
+		if reason != "" {
+			server.Log(LevelWarn, "Connection rejected", "addr", conn.RemoteAddr(), "reason", reason)
+			server.sendEvent(EventError, conn.RemoteAddr().String(), reason)
+			conn.Close()
+			continue
+		}
+		connection := server.newConnection(ln.scheme, conn)
+		connection.accepted = true
+		connection.ip = ip
+		server.sendEvent(EventConnected, connection.addr, "accepted")
+		go server.receiver(connection)
 	}
 }
 
-// CreateServer creates new messaging server
+// CreateServer creates new messaging server which listens
+// Opt.Addr and Opt.ListenAddrs
 func CreateServer(options Options) (*MessageServer, error) {
 	server := &MessageServer{
 		Opt:     options,
-		Conns:   make(map[string]net.Conn),
+		Conns:   make(map[string]*Connection),
 		recChan: make(chan Msg, 10),
+		eventCh: make(chan Event, 10),
+		ipConns: map[string]int{},
+		done:    make(chan struct{}),
 	}
-	ln, err := net.Listen("tcp", options.Addr)
-	if err != nil {
-		return nil, err
+	if options.AcceptRate > 0 {
+		server.acceptLimiter = newTokenBucket(options.AcceptRate, options.AcceptBurst)
 	}
-	server.Listener = ln
+	server.sendLimiter = newRateLimiter(options.ServerSendLimit)
+	server.recvLimiter = newRateLimiter(options.ServerRecvLimit)
+	for _, addr := range append([]string{options.Addr}, options.ListenAddrs...) {
+		ln, err := listen(withDatagramScheme(addr, options.Datagram))
+		if err != nil {
+			for _, opened := range server.listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		if dl, isDatagram := ln.Listener.(*udpListener); isDatagram {
+			dl.setLimits(server.datagramIdleTimeout(), server.maxDatagramConns())
+		}
+		server.listeners = append(server.listeners, ln)
+	}
+	server.Listener = server.listeners[0].Listener
 
-	go server.acceptor()
+	for _, ln := range server.listeners {
+		go server.acceptor(ln)
+	}
 	return server, nil
 }
 
+// Close closes listeners and all connections of server,
+// receiving from server returns ErrServerClosed after that
+func (server *MessageServer) Close() {
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return
+	}
+	server.closed = true
+	close(server.done)
+	conns := []*Connection{}
+	for _, connection := range server.Conns {
+		conns = append(conns, connection)
+	}
+	server.lock.Unlock()
+
+	for _, ln := range server.listeners {
+		ln.Close()
+	}
+	for _, connection := range conns {
+		connection.closeWithReason(ErrServerClosed.Error())
+	}
+}
+
+func (server *MessageServer) isClosed() bool {
+	select {
+	case <-server.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func listen(addr string) (listener, error) {
+	transport, scheme, transportAddr, err := getTransport(addr)
+	if err != nil {
+		return listener{}, err
+	}
+	ln, err := transport.Listen(transportAddr)
+	if err != nil {
+		return listener{}, err
+	}
+	return listener{Listener: ln, scheme: scheme}, nil
+}
+
+// Addrs returns addresses which server is listening,
+// with actual ports if port 0 was given (like ":0")
+func (server *MessageServer) Addrs() []string {
+	addrs := []string{}
+	for _, ln := range server.listeners {
+		addr := ln.Addr().String()
+		if ln.scheme != DefaultScheme {
+			addr = ln.scheme + "://" + addr
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
 // Msg represents message
 type Msg struct {
 	FromAddr string
 	Data     string
+
+	// CallID is set if message is request sent with Connection.Call
+	CallID string
 }
 
-// Connection represents one (TCP) connection
+// Connection represents one connection
 type Connection struct {
 	Conn      net.Conn
 	ServerRef *MessageServer
+	addr      string
+	recChan   chan Msg
+	done      chan struct{}
+	direct    bool
+	lock      sync.RWMutex
+
+	lastReceived      time.Time
+	closed            bool
+	closeReason       string
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	outbox            chan outItem
+	stats             ConnStats
+	compress          bool
+	offerHello        bool
+	helloSent         bool
+	peerHello         bool
+	peerDeflate       bool
+	calls             map[string]chan string
+	callSeq           int
+	accepted          bool
+	ip                string
+	datagram          bool
+	sendLimiter       *rateLimiter
+	recvLimiter       *rateLimiter
+}
+
+// ConnOptions contains options for opening connection
+type ConnOptions struct {
+	// DirectReceive delivers messages from connection to Connection.Receive
+	// instead of MessageServer.Receive
+	DirectReceive bool
+
+	// HeartbeatInterval and HeartbeatMisses override server options
+	// for new connection (if non-zero)
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+
+	// Compression offers compression to peer (like if address is in
+	// CompressionPeers of server) and compresses messages towards it
+	// (peer must support compression negotiation)
+	Compression bool
+
+	// options for OpenReconnectingConnection: delay between dialing attempts
+	// grows from ReconnectMinDelay (default 100ms) to ReconnectMaxDelay
+	// (default 30s) and ReconnectBuffer messages (default 100) can be
+	// buffered while disconnected
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+	ReconnectBuffer   int
+}
+
+// SetFromMap sets connection options from name-value map (like FunL options map)
+func (opt *ConnOptions) SetFromMap(options map[string]interface{}) error {
+	var err error
+	if opt.DirectReceive, err = boolOption(options, "direct-receive", opt.DirectReceive); err != nil {
+		return err
+	}
+	if opt.HeartbeatInterval, err = durationOption(options, "heartbeat-interval", opt.HeartbeatInterval); err != nil {
+		return err
+	}
+	if opt.HeartbeatMisses, err = intOption(options, "heartbeat-misses", opt.HeartbeatMisses); err != nil {
+		return err
+	}
+	if opt.Compression, err = boolOption(options, "compression", opt.Compression); err != nil {
+		return err
+	}
+	if opt.ReconnectMinDelay, err = durationOption(options, "reconnect-min-delay", opt.ReconnectMinDelay); err != nil {
+		return err
+	}
+	if opt.ReconnectMaxDelay, err = durationOption(options, "reconnect-max-delay", opt.ReconnectMaxDelay); err != nil {
+		return err
+	}
+	if opt.ReconnectBuffer, err = intOption(options, "reconnect-buffer", opt.ReconnectBuffer); err != nil {
+		return err
+	}
+	return nil
 }
 
 // OpenConnection opens new connection towards given address
 func (server *MessageServer) OpenConnection(addr string) (*Connection, error) {
-	conn, found := server.getConn(addr)
+	return server.OpenConnectionWithOptions(addr, ConnOptions{})
+}
+
+// OpenConnectionWithOptions opens new connection towards given address with options
+func (server *MessageServer) OpenConnectionWithOptions(addr string, options ConnOptions) (*Connection, error) {
+	return server.OpenConnectionContext(context.Background(), addr, options)
+}
+
+// OpenConnectionContext opens new connection towards given address with options,
+// dialing is cancelled when context is done, server is closed or Opt.DialTimeout
+// is reached (dialing can be cancelled only with transports implementing ContextDialer)
+func (server *MessageServer) OpenConnectionContext(ctx context.Context, addr string, options ConnOptions) (*Connection, error) {
+	if server.isClosed() {
+		return nil, ErrServerClosed
+	}
+	addr = withDatagramScheme(addr, server.Opt.Datagram)
+	connAddr := addr
+	if scheme, transportAddr := SplitAddr(addr); scheme == DefaultScheme {
+		connAddr = transportAddr
+	}
+	connection, found := server.getConn(connAddr)
 	if found {
-		connection := &Connection{
-			Conn:      conn,
-			ServerRef: server,
+		if options.DirectReceive {
+			connection.setDirect()
 		}
 		return connection, nil
 	}
-	var err error
-	conn, err = net.Dial("tcp", addr)
+	transport, scheme, transportAddr, err := getTransport(addr)
 	if err != nil {
 		return nil, err
 	}
-	go server.receiver(conn)
-	connection := &Connection{
-		Conn:      conn,
-		ServerRef: server,
+	conn, err := server.dial(ctx, transport, transportAddr)
+	if err != nil {
+		return nil, err
 	}
+	connection = server.newConnection(scheme, conn)
+	if options.DirectReceive {
+		connection.setDirect()
+	}
+	if options.HeartbeatInterval > 0 {
+		connection.heartbeatInterval = options.HeartbeatInterval
+	}
+	if options.HeartbeatMisses > 0 {
+		connection.heartbeatMisses = options.HeartbeatMisses
+	}
+	connection.compress = connection.compress || options.Compression
+	connection.offerHello = options.Compression || (server.Opt.Compression && hasString(server.Opt.CompressionPeers, addr))
+	server.sendEvent(EventConnected, connection.addr, "opened")
+	go server.receiver(connection)
 	return connection, nil
 }
 
 // Receive message
 func (server *MessageServer) Receive() (Msg, error) {
-	msg := <-server.recChan
-	return msg, nil
+	return server.ReceiveContext(context.Background())
+}
+
+// ReceiveContext receives message, waiting until message arrives or context is done
+func (server *MessageServer) ReceiveContext(ctx context.Context) (Msg, error) {
+	select {
+	case msg := <-server.recChan:
+		return msg, nil
+	case <-server.done:
+		// messages received before closing are still delivered
+		select {
+		case msg := <-server.recChan:
+			return msg, nil
+		default:
+		}
+		return Msg{}, ErrServerClosed
+	case <-ctx.Done():
+		return Msg{}, ctx.Err()
+	}
+}
+
+// Events returns channel from which connection events can be received,
+// events are dropped if channel is full
+func (server *MessageServer) Events() <-chan Event {
+	return server.eventCh
+}
+
+// ReceiveEvent receives connection event, waiting at most given time
+// (zero timeout waits until event is received)
+func (server *MessageServer) ReceiveEvent(timeout time.Duration) (Event, error) {
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case event := <-server.eventCh:
+		return event, nil
+	case <-server.done:
+		// events of closing connections are still delivered
+		select {
+		case event := <-server.eventCh:
+			return event, nil
+		default:
+		}
+		return Event{}, ErrServerClosed
+	case <-timeoutCh:
+		return Event{}, ErrTimeout
+	}
+}
+
+// ReceiveTimeout receives message, waiting at most given time
+func (server *MessageServer) ReceiveTimeout(timeout time.Duration) (Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	msg, err := server.ReceiveContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return msg, ErrTimeout
+	}
+	return msg, err
+}
+
+func (con *Connection) setDirect() {
+	con.lock.Lock()
+	defer con.lock.Unlock()
+
+	con.direct = true
+}
+
+func (con *Connection) isDirect() bool {
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	return con.direct
+}
+
+// Receive receives message from this connection only,
+// connection needs to be opened with DirectReceive option
+func (con *Connection) Receive() (Msg, error) {
+	return con.ReceiveContext(context.Background())
+}
+
+// ReceiveContext receives message from connection, waiting until message arrives,
+// connection is closed or context is done
+func (con *Connection) ReceiveContext(ctx context.Context) (Msg, error) {
+	select {
+	case msg := <-con.recChan:
+		return msg, nil
+	case <-con.done:
+		// messages received before closing are still delivered
+		select {
+		case msg := <-con.recChan:
+			return msg, nil
+		default:
+		}
+		return Msg{}, ErrConnectionClosed
+	case <-ctx.Done():
+		return Msg{}, ctx.Err()
+	}
 }
 
-// Send sends message to connection
+// ReceiveTimeout receives message from connection, waiting at most given time
+func (con *Connection) ReceiveTimeout(timeout time.Duration) (Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	msg, err := con.ReceiveContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return msg, ErrTimeout
+	}
+	return msg, err
+}
+
+func (con *Connection) handleControl(f frame) {
+	switch f.control {
+	case ctrlPing:
+		con.enqueue(controlFrame(ctrlPong, ""), false)
+	case ctrlPong:
+		// receiving is enough for heartbeat
+	case ctrlHello:
+		con.handleHello(f.payload)
+	case ctrlReply:
+		con.handleReply(f.payload)
+	}
+}
+
+// Send sends message to connection, waits until message is written
 func (con *Connection) Send(data string) error {
-	b := append([]byte(data), 0)
-	_, err := con.Conn.Write(b)
-	return err
+	return con.waitResult(con.enqueue(con.encodeData(data, false), true))
+}
+
+func (con *Connection) getCloseReason() string {
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	return con.closeReason
+}
+
+func (con *Connection) isClosed() bool {
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	return con.closed
+}
+
+func (con *Connection) closeWithReason(reason string) {
+	con.lock.Lock()
+	if !con.closed {
+		con.closeReason = reason
+		con.closed = true
+	}
+	con.lock.Unlock()
+
+	con.Conn.Close()
+}
+
+// State returns state of connection
+func (con *Connection) State() ConnState {
+	select {
+	case <-con.done:
+		return StateClosed
+	default:
+	}
+	if con.isClosed() {
+		return StateClosed
+	}
+	return StateConnected
 }
 
 // Close connection
 func (con *Connection) Close() {
-	con.Conn.Close()
+	con.closeWithReason("")
 }
@@ -0,0 +1,870 @@
+package msg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anssihalmeaho/mzq/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer creates server which is closed when test ends
+func newTestServer(t *testing.T, options Options) *MessageServer {
+	server, err := CreateServer(options)
+	if err != nil {
+		t.Fatalf("CreateServer failed: %v", err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "127.0.0.1:0"})
+
+	_, err := server.ReceiveTimeout(10 * time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+}
+
+func TestDirectReceive(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "127.0.0.1:0"})
+	client := newTestServer(t, Options{Addr: "127.0.0.1:0"})
+
+	con, err := client.OpenConnectionWithOptions(server.Listener.Addr().String(), ConnOptions{DirectReceive: true})
+	assert.Nil(err)
+	assert.Nil(con.Send("request"))
+
+	req, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("request", req.Data)
+
+	replyCon, err := server.OpenConnection(req.FromAddr)
+	assert.Nil(err)
+	assert.Nil(replyCon.Send("reply"))
+
+	reply, err := con.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("reply", reply.Data)
+
+	_, err = client.ReceiveTimeout(10 * time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+
+	con.Close()
+	_, err = con.ReceiveTimeout(time.Second)
+	assert.Equal(ErrConnectionClosed, err)
+}
+
+func TestUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	addr := "unix://" + filepath.Join(t.TempDir(), "mzq.sock")
+	server := newTestServer(t, Options{Addr: addr})
+	client := newTestServer(t, Options{Addr: "127.0.0.1:0"})
+
+	con, err := client.OpenConnectionWithOptions(addr, ConnOptions{DirectReceive: true})
+	assert.Nil(err)
+	assert.Nil(con.Send("request"))
+
+	req, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("request", req.Data)
+
+	replyCon, err := server.OpenConnection(req.FromAddr)
+	assert.Nil(err)
+	assert.Nil(replyCon.Send("reply"))
+
+	reply, err := con.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("reply", reply.Data)
+}
+
+func TestConnectionEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-events-server"})
+	client := newTestServer(t, Options{Addr: "mem://test-events-client"})
+
+	con, err := client.OpenConnection("mem://test-events-server")
+	assert.Nil(err)
+
+	event, err := client.ReceiveEvent(time.Second)
+	assert.Nil(err)
+	assert.Equal(Event{Type: EventConnected, Addr: "mem://test-events-server", Reason: "opened"}, event)
+
+	event, err = server.ReceiveEvent(time.Second)
+	assert.Nil(err)
+	assert.Equal(EventConnected, event.Type)
+	acceptedAddr := event.Addr
+
+	con.Close()
+
+	event, err = client.ReceiveEvent(time.Second)
+	assert.Nil(err)
+	assert.Equal(Event{Type: EventDisconnected, Addr: "mem://test-events-server", Reason: "closed"}, event)
+
+	event, err = server.ReceiveEvent(time.Second)
+	assert.Nil(err)
+	assert.Equal(Event{Type: EventDisconnected, Addr: acceptedAddr, Reason: "closed by peer"}, event)
+}
+
+func TestHeartbeat(t *testing.T) {
+	assert := assert.New(t)
+
+	// peer which reads everything but never answers
+	transport, _, transportAddr, err := getTransport("mem://test-heartbeat-silent")
+	assert.Nil(err)
+	ln, err := transport.Listen(transportAddr)
+	assert.Nil(err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	server := newTestServer(t, Options{Addr: "mem://test-heartbeat-server", HeartbeatInterval: 10 * time.Millisecond})
+	client := newTestServer(t, Options{Addr: "mem://test-heartbeat-client"})
+
+	// connection to live peer stays up
+	alive, err := client.OpenConnection("mem://test-heartbeat-server")
+	assert.Nil(err)
+
+	silent, err := client.OpenConnectionWithOptions("mem://test-heartbeat-silent", ConnOptions{
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatMisses:   2,
+	})
+	assert.Nil(err)
+
+	_, err = silent.ReceiveTimeout(time.Second)
+	assert.Equal(ErrConnectionClosed, err)
+	assert.Equal("heartbeat timeout", silent.getCloseReason())
+
+	assert.Nil(alive.Send("still here"))
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("still here", msg.Data)
+}
+
+func TestFrameEscaping(t *testing.T) {
+	assert := assert.New(t)
+
+	data := string([]byte{controlPrefix}) + "ping:"
+	assert.Equal(frame{data: data}, parseFrame(dataFrame(data, true)))
+	assert.Equal(frame{data: ""}, parseFrame(dataFrame("", true)))
+	assert.Equal(frame{control: ctrlPing}, parseFrame(controlFrame(ctrlPing, "")))
+	assert.Equal(frame{control: ctrlReply, payload: "a:b"}, parseFrame(controlFrame(ctrlReply, "a:b")))
+
+	// data is not escaped towards older peers, unknown control names
+	// (data from older peers) are data
+	data = string([]byte{controlPrefix}) + "data"
+	assert.Equal(append([]byte(data), 0), dataFrame(data, false))
+	assert.Equal(frame{data: data}, parseFrame(dataFrame(data, false)))
+	assert.Equal(frame{data: data + ":x"}, parseFrame(dataFrame(data+":x", false)))
+}
+
+func TestSendAsync(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-async-server"})
+	client := newTestServer(t, Options{Addr: "mem://test-async-client", OutboxSize: 5})
+
+	con, err := client.OpenConnection("mem://test-async-server")
+	assert.Nil(err)
+
+	results := []<-chan error{}
+	for i := 0; i < 5; i++ {
+		results = append(results, con.SendAsync(fmt.Sprintf("msg-%d", i)))
+	}
+	for i := 0; i < 5; i++ {
+		msg, err := server.ReceiveTimeout(time.Second)
+		assert.Nil(err)
+		assert.Equal(fmt.Sprintf("msg-%d", i), msg.Data)
+	}
+	for _, result := range results {
+		assert.Nil(<-result)
+	}
+
+	stats := con.Stats()
+	assert.Equal(5, stats.SentFrames)
+	assert.Equal(5, stats.OutboxCapacity)
+	assert.Equal(0, stats.OutboxDepth)
+
+	con.Close()
+	assert.Equal(ErrConnectionClosed, con.Send("closed"))
+}
+
+func TestSendAsyncPeerClose(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-async-close-server"})
+	client := newTestServer(t, Options{Addr: "mem://test-async-close-client"})
+
+	con, err := client.OpenConnection("mem://test-async-close-server")
+	assert.Nil(err)
+
+	// sending continues while peer closes connection
+	results := make(chan (<-chan error), 1000)
+	go func() {
+		defer close(results)
+		for i := 0; i < cap(results); i++ {
+			results <- con.SendAsync(fmt.Sprintf("msg-%d", i))
+		}
+	}()
+	server.Close()
+
+	for result := range results {
+		select {
+		case <-result:
+		case <-time.After(time.Second):
+			t.Fatal("result of send not received")
+		}
+	}
+	testutil.WaitFor(t, func() bool {
+		return con.State() == StateClosed
+	}, "connection not closed")
+	assert.Equal(ErrConnectionClosed, <-con.SendAsync("closed"))
+}
+
+func TestCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-compress-server"})
+	client := newTestServer(t, Options{
+		Addr:             "mem://test-compress-client",
+		Compression:      true,
+		CompressionPeers: []string{"mem://test-compress-server"},
+	})
+
+	con, err := client.OpenConnection("mem://test-compress-server")
+	assert.Nil(err)
+
+	// wait for hello from peer
+	testutil.WaitFor(t, func() bool {
+		return con.useCompression(strings.Repeat("x", 1000))
+	}, "hello not received")
+
+	data := strings.Repeat("{'key' 'value'} ", 100) + string([]byte{0xff, escByte, controlPrefix})
+	assert.Nil(con.Send(data))
+	assert.Nil(con.Send("short"))
+
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal(data, msg.Data)
+	msg, err = server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("short", msg.Data)
+
+	stats := con.Stats()
+	assert.Equal(1, stats.CompressedMessages)
+	assert.Equal(len(data), stats.UncompressedBytes)
+	assert.True(stats.CompressionRatio() < 0.5)
+}
+
+func TestOlderPeer(t *testing.T) {
+	assert := assert.New(t)
+
+	// peer of older version reads and writes zero separated data as it is
+	transport, _, transportAddr, err := getTransport("mem://test-older-peer")
+	assert.Nil(err)
+	ln, err := transport.Listen(transportAddr)
+	assert.Nil(err)
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client := newTestServer(t, Options{Addr: "mem://test-older-client", Compression: true, CompressionThreshold: 10})
+	con, err := client.OpenConnection("mem://test-older-peer")
+	assert.Nil(err)
+	peer := <-accepted
+	t.Cleanup(func() { peer.Close() })
+
+	// no hello, no compression and no escaping towards older peer
+	sent := []string{strings.Repeat("long message ", 20), string([]byte{controlPrefix, controlPrefix}) + "data"}
+	frames := make(chan string, 16)
+	go func() {
+		reader := bufio.NewReader(peer)
+		for {
+			b, err := reader.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			frames <- string(b[:len(b)-1])
+		}
+	}()
+	for _, data := range sent {
+		assert.Nil(con.Send(data))
+	}
+	for _, data := range sent {
+		select {
+		case frame := <-frames:
+			assert.Equal(data, frame)
+		case <-time.After(time.Second):
+			t.Fatal("data not received by older peer")
+		}
+	}
+
+	// data from older peer is received as it is
+	received := []string{string([]byte{controlPrefix}) + "hello world", "plain"}
+	for _, data := range received {
+		_, err = peer.Write(append([]byte(data), 0))
+		assert.Nil(err)
+	}
+	for _, data := range received {
+		msg, err := client.ReceiveTimeout(time.Second)
+		assert.Nil(err)
+		assert.Equal(data, msg.Data)
+	}
+}
+
+func TestCall(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-call-server", Compression: true, CompressionThreshold: 10})
+	client := newTestServer(t, Options{
+		Addr:                 "mem://test-call-client",
+		Compression:          true,
+		CompressionThreshold: 10,
+		CompressionPeers:     []string{"mem://test-call-server"},
+	})
+
+	go func() {
+		for {
+			req, err := server.Receive()
+			if err != nil {
+				return
+			}
+			if req.Data == "no reply" {
+				continue
+			}
+			server.Reply(req, "reply to "+req.Data)
+		}
+	}()
+
+	con, err := client.OpenConnection("mem://test-call-server")
+	assert.Nil(err)
+
+	for _, data := range []string{"short", strings.Repeat("long request ", 20)} {
+		reply, err := con.CallTimeout(data, time.Second)
+		assert.Nil(err)
+		assert.Equal("reply to "+data, reply)
+	}
+
+	_, err = con.CallTimeout("no reply", 10*time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+
+	assert.Equal(ErrNotRequest, server.Reply(Msg{FromAddr: "mem://@1", Data: "x"}, "y"))
+}
+
+func TestCallOutboxFull(t *testing.T) {
+	assert := assert.New(t)
+
+	// peer which doesn't read blocks writing
+	transport, _, transportAddr, err := getTransport("mem://test-call-full-peer")
+	assert.Nil(err)
+	ln, err := transport.Listen(transportAddr)
+	assert.Nil(err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		if peer, err := ln.Accept(); err == nil {
+			t.Cleanup(func() { peer.Close() })
+		}
+	}()
+
+	client := newTestServer(t, Options{Addr: "mem://test-call-full-client", OutboxSize: 1})
+	con, err := client.OpenConnection("mem://test-call-full-peer")
+	assert.Nil(err)
+	con.SendAsync("written")
+	testutil.WaitFor(t, func() bool { return con.Stats().OutboxDepth == 0 }, "writing not started")
+	con.SendAsync("waiting")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := con.Call(ctx, "request")
+		result <- err
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("call not cancelled")
+	}
+
+	_, err = con.CallTimeout("request", 10*time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+}
+
+func waitEvent(t *testing.T, server *MessageServer, eventType EventType) Event {
+	for {
+		event, err := server.ReceiveEvent(time.Second)
+		if err != nil {
+			t.Fatalf("event %v not received: %v", eventType, err)
+		}
+		if event.Type == eventType {
+			return event
+		}
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-maxframe-server", MaxFrameSize: 10})
+	client := newTestServer(t, Options{Addr: "mem://test-maxframe-client"})
+
+	con, err := client.OpenConnection("mem://test-maxframe-server")
+	assert.Nil(err)
+	assert.Nil(con.Send("0123456789"))
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("0123456789", msg.Data)
+
+	con.SendAsync(strings.Repeat("x", 5000))
+	event := waitEvent(t, server, EventDisconnected)
+	assert.Equal("frame too large (max 10 bytes)", event.Reason)
+	assert.Equal(1, server.Stats().OversizedFrames)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "127.0.0.1:0", MaxConnsPerIP: 1})
+	client := newTestServer(t, Options{Addr: "mem://test-limits-client"})
+
+	_, err := client.OpenConnection(server.Listener.Addr().String())
+	assert.Nil(err)
+	waitEvent(t, server, EventConnected)
+
+	// second connection from same IP is closed by server
+	second, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.Nil(err)
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err)
+
+	stats := server.Stats()
+	assert.Equal(1, stats.AcceptedConnections)
+	assert.Equal(1, stats.RejectedConnections)
+	assert.Equal(1, stats.Connections)
+}
+
+// waitState waits until connection state is set after flushing buffered messages
+func waitState(t *testing.T, rc *ReconnectingConnection, state ConnState) {
+	t.Helper()
+	testutil.WaitFor(t, func() bool {
+		return rc.State() == state
+	}, "state %v not reached", state)
+}
+
+func TestReconnectingConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	client := newTestServer(t, Options{Addr: "mem://test-reconnect-client"})
+
+	// peer is not up yet, messages are buffered
+	rc, err := client.OpenReconnectingConnection("mem://test-reconnect-server", ConnOptions{
+		ReconnectMinDelay: time.Millisecond,
+		ReconnectMaxDelay: 10 * time.Millisecond,
+	})
+	assert.Nil(err)
+	defer rc.Close()
+	assert.Nil(rc.Send("buffered"))
+
+	server := newTestServer(t, Options{Addr: "mem://test-reconnect-server"})
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("buffered", msg.Data)
+	waitState(t, rc, StateConnected)
+
+	// connection is lost and re-established
+	con, found := server.getConn(msg.FromAddr)
+	assert.True(found)
+	con.Close()
+	waitEvent(t, client, EventDisconnected)
+	waitEvent(t, client, EventConnected)
+
+	assert.Nil(rc.Send("after reconnect"))
+	msg, err = server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("after reconnect", msg.Data)
+	assert.Equal(1, rc.Stats().Reconnects)
+
+	rc.Close()
+	assert.Equal(StateClosed, rc.State())
+	assert.Equal(ErrConnectionClosed, rc.Send("closed"))
+}
+
+func TestSharedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-auth-server", SharedSecret: "secret"})
+	client := newTestServer(t, Options{Addr: "mem://test-auth-client", SharedSecret: "secret"})
+
+	con, err := client.OpenConnection("mem://test-auth-server")
+	assert.Nil(err)
+	assert.Nil(con.Send("authenticated"))
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("authenticated", msg.Data)
+
+	// peer with wrong secret is rejected
+	intruder := newTestServer(t, Options{Addr: "mem://test-auth-intruder", SharedSecret: "wrong"})
+	con, err = intruder.OpenConnection("mem://test-auth-server")
+	assert.Nil(err)
+	assert.NotNil(con.Send("not authenticated"))
+	event := waitEvent(t, server, EventError)
+	assert.Equal("authentication failed", event.Reason)
+	_, err = server.ReceiveTimeout(100 * time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+
+	// peer without secret is rejected
+	plain := newTestServer(t, Options{Addr: "mem://test-auth-plain"})
+	con, err = plain.OpenConnection("mem://test-auth-server")
+	assert.Nil(err)
+	con.Send("not authenticated")
+	waitEvent(t, server, EventError)
+	_, err = server.ReceiveTimeout(100 * time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+}
+
+func TestAuthReflection(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "mem://test-auth-reflect-server", SharedSecret: "secret", AuthTimeout: time.Second})
+	transport, _, transportAddr, err := getTransport("mem://test-auth-reflect-server")
+	assert.Nil(err)
+
+	// attacker without secret opens two connections and gives
+	// each connection nonce of the other
+	conns := []net.Conn{}
+	readers := []*bufio.Reader{}
+	nonces := [][]byte{}
+	for i := 0; i < 2; i++ {
+		conn, err := transport.Dial(transportAddr)
+		assert.Nil(err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		nonce, err := readAuthFrame(reader, ctrlAuthNonce)
+		assert.Nil(err)
+		conns = append(conns, conn)
+		readers = append(readers, reader)
+		nonces = append(nonces, nonce)
+	}
+	proofs := [][]byte{}
+	for i, conn := range conns {
+		_, err := conn.Write(controlFrame(ctrlAuthNonce, hex.EncodeToString(nonces[1-i])))
+		assert.Nil(err)
+	}
+	for _, reader := range readers {
+		proof, err := readAuthFrame(reader, ctrlAuthProof)
+		assert.Nil(err)
+		proofs = append(proofs, proof)
+	}
+
+	// proof of server in 2nd connection is sent back in 1st one
+	_, err = conns[0].Write(controlFrame(ctrlAuthProof, hex.EncodeToString(proofs[1])))
+	assert.Nil(err)
+	event := waitEvent(t, server, EventError)
+	assert.Equal(ErrAuthFailed.Error(), event.Reason)
+
+	conns[0].Write(dataFrame("injected without secret", false))
+	_, err = server.ReceiveTimeout(100 * time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	NewTextLogger(&buf).Log(LevelWarn, "Connection rejected", "addr", "mem://x", "reason", "too many")
+	assert.Regexp(`^time=\S+ level=WARN msg="Connection rejected" addr=mem://x reason="too many"\n$`, buf.String())
+
+	records := make(chan string, 10)
+	logger := LoggerFunc(func(level LogLevel, message string, fields ...interface{}) {
+		records <- fmt.Sprintf("%v %s %v", level, message, LogFields(fields...))
+	})
+	newTestServer(t, Options{Addr: "mem://test-logger-server", SharedSecret: "secret", Logger: logger})
+	client := newTestServer(t, Options{Addr: "mem://test-logger-client", Logger: logger, LogLevel: LevelError})
+
+	con, err := client.OpenConnection("mem://test-logger-server")
+	assert.Nil(err)
+	con.Send("not authenticated")
+	select {
+	case record := <-records:
+		assert.Regexp(`^WARN Closing connection map\[addr:mem://@\d+ reason:authentication failed\]$`, record)
+	case <-time.After(time.Second):
+		t.Fatal("log record not received")
+	}
+	// debug records are not logged by default
+	assert.Equal(0, len(records))
+}
+
+func TestDefaultLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	// only warnings and errors are logged without logger
+	server := newTestServer(t, Options{Addr: "mem://test-default-logger"})
+	logger, level := server.logger()
+	assert.Equal(DefaultLogger, logger)
+	assert.Equal(LevelWarn, level)
+
+	// level given in options map is used with default logger
+	opt := Options{Addr: "mem://test-default-logger-info"}
+	assert.Nil(opt.SetFromMap(map[string]interface{}{"log-level": "info"}))
+	server = newTestServer(t, opt)
+	logger, level = server.logger()
+	assert.Equal(DefaultLogger, logger)
+	assert.Equal(LevelInfo, level)
+}
+
+func TestDatagram(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "127.0.0.1:0", Datagram: true})
+	client := newTestServer(t, Options{Addr: "mem://test-datagram-client", DatagramSequence: true, MaxDatagramSize: 100})
+
+	con, err := client.OpenConnectionWithOptions("udp://"+server.Listener.Addr().String(), ConnOptions{DirectReceive: true})
+	assert.Nil(err)
+	assert.Nil(con.Send("ping"))
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("ping", msg.Data)
+	assert.True(strings.HasPrefix(msg.FromAddr, "udp://127.0.0.1:"))
+
+	// reply to sender address
+	reply, err := server.OpenConnection(msg.FromAddr)
+	assert.Nil(err)
+	assert.Nil(reply.Send("pong"))
+	msg, err = con.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("pong", msg.Data)
+
+	// too large message is not sent
+	assert.Equal(ErrFrameTooLarge, con.Send(strings.Repeat("x", 100)))
+	assert.Equal(StateConnected, con.State())
+}
+
+func TestDatagramLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{
+		Addr:                "udp://127.0.0.1:0",
+		DatagramIdleTimeout: 100 * time.Millisecond,
+		MaxDatagramConns:    1,
+	})
+	addr := server.Addrs()[0]
+	client1 := newTestServer(t, Options{Addr: "mem://test-datagram-limits-1"})
+	client2 := newTestServer(t, Options{Addr: "mem://test-datagram-limits-2"})
+
+	con1, err := client1.OpenConnection(addr)
+	assert.Nil(err)
+	assert.Nil(con1.Send("first"))
+	msg, err := server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("first", msg.Data)
+	assert.Equal(EventConnected, waitEvent(t, server, EventConnected).Type)
+
+	// datagrams from new address are dropped when limit is reached
+	con2, err := client2.OpenConnection(addr)
+	assert.Nil(err)
+	assert.Nil(con2.Send("second"))
+	_, err = server.ReceiveTimeout(50 * time.Millisecond)
+	assert.Equal(ErrTimeout, err)
+
+	// idle connection is closed so that new address gets connected
+	event := waitEvent(t, server, EventDisconnected)
+	assert.Equal(msg.FromAddr, event.Addr)
+	assert.Nil(con2.Send("third"))
+	msg, err = server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+	assert.Equal("third", msg.Data)
+}
+
+func TestDatagramSequence(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := newUDPConn(nil, nil, nil)
+	for _, seq := range []byte{0, 1, 3, 2, 4} {
+		conn.deliver([]byte{udpFlagSequence, 0, 0, 0, seq, 'a', 0})
+	}
+	lost, dropped := conn.datagramStats()
+	assert.Equal(1, lost)
+	assert.Equal(0, dropped)
+
+	// late datagram is dropped
+	assert.Equal(4, len(conn.inbox))
+}
+
+func TestListenAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{
+		Addr:        "127.0.0.1:0",
+		ListenAddrs: []string{"mem://test-listen-addrs", "udp://127.0.0.1:0"},
+	})
+	addrs := server.Addrs()
+	assert.Equal(3, len(addrs))
+	assert.Regexp(`^127\.0\.0\.1:[1-9]\d*$`, addrs[0])
+	assert.Equal("mem://test-listen-addrs", addrs[1])
+	assert.Regexp(`^udp://127\.0\.0\.1:[1-9]\d*$`, addrs[2])
+
+	client := newTestServer(t, Options{Addr: "mem://test-listen-addrs-client"})
+	for _, addr := range addrs {
+		con, err := client.OpenConnection(addr)
+		assert.Nil(err)
+		assert.Nil(con.Send(addr))
+		msg, err := server.ReceiveTimeout(time.Second)
+		assert.Nil(err)
+		assert.Equal(addr, msg.Data)
+	}
+
+	// listeners are closed if some address can't be listened
+	_, err := CreateServer(Options{Addr: "mem://test-listen-addrs-2", ListenAddrs: []string{"mem://test-listen-addrs"}})
+	assert.NotNil(err)
+	newTestServer(t, Options{Addr: "mem://test-listen-addrs-2"})
+}
+
+func TestRateLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := newTestServer(t, Options{Addr: "mem://test-ratelimit-sink"})
+	client := newTestServer(t, Options{
+		Addr:      "mem://test-ratelimit-client",
+		SendLimit: RateLimit{BytesPerSec: 1000, ByteBurst: 10},
+	})
+
+	// 10 messages of 10 bytes (with delimiter) take ~90ms, throttle time
+	// may be less than elapsed time as timer overshoot refills tokens
+	con, err := client.OpenConnection("mem://test-ratelimit-sink")
+	assert.Nil(err)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.Nil(con.Send("123456789"))
+	}
+	assert.True(time.Since(start) >= 80*time.Millisecond)
+	stats := con.Stats()
+	assert.True(stats.SendThrottle.Throttled > 0)
+	assert.True(stats.SendThrottle.ThrottleTime > 0)
+
+	for i := 0; i < 10; i++ {
+		_, err := sink.ReceiveTimeout(time.Second)
+		assert.Nil(err)
+	}
+	assert.Equal(stats.SendThrottle, client.Stats().SendThrottle)
+
+	// receiving is limited to 100 messages per second
+	server := newTestServer(t, Options{
+		Addr:            "mem://test-ratelimit-server",
+		ServerRecvLimit: RateLimit{MessagesPerSec: 100, MessageBurst: 1},
+	})
+	fast := newTestServer(t, Options{Addr: "mem://test-ratelimit-fast"})
+	fastCon, err := fast.OpenConnection("mem://test-ratelimit-server")
+	assert.Nil(err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(fastCon.Send("123456789"))
+	}
+	for i := 0; i < 5; i++ {
+		_, err := server.ReceiveTimeout(time.Second)
+		assert.Nil(err)
+	}
+	assert.True(server.Stats().RecvThrottle.Throttled > 0)
+}
+
+func TestServerClose(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newTestServer(t, Options{Addr: "127.0.0.1:0"})
+	addr := server.Addrs()[0]
+	client := newTestServer(t, Options{Addr: "mem://test-server-close-client"})
+	con, err := client.OpenConnection(addr)
+	assert.Nil(err)
+	assert.Nil(con.Send("before close"))
+	_, err = server.ReceiveTimeout(time.Second)
+	assert.Nil(err)
+
+	rc, err := server.OpenReconnectingConnection("mem://test-server-close-client", ConnOptions{ReconnectMinDelay: time.Millisecond})
+	assert.Nil(err)
+	waitState(t, rc, StateConnected)
+
+	server.Close()
+	server.Close()
+	_, err = server.Receive()
+	assert.Equal(ErrServerClosed, err)
+	_, err = server.OpenConnection("mem://test-server-close-client")
+	assert.Equal(ErrServerClosed, err)
+	waitState(t, rc, StateClosed)
+
+	// connections are closed
+	testutil.WaitFor(t, func() bool {
+		return con.State() == StateClosed
+	}, "connection not closed")
+	assert.Equal(0, server.Stats().Connections)
+
+	// address can be listened again
+	server, err = CreateServer(Options{Addr: addr})
+	assert.Nil(err)
+	server.Close()
+}
+
+func TestDialTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	transport := testutil.NewBlockTransport(1)
+	RegisterTransport("block", transport)
+	server := newTestServer(t, Options{Addr: "mem://test-dial-timeout", DialTimeout: 20 * time.Millisecond})
+	start := time.Now()
+	_, err := server.OpenConnection("block://somewhere")
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.True(time.Since(start) < time.Second)
+
+	// closing server cancels dialing
+	server = newTestServer(t, Options{Addr: "mem://test-dial-close"})
+	result := make(chan error, 1)
+	go func() {
+		_, err := server.OpenConnection("block://somewhere")
+		result <- err
+	}()
+	<-transport.Dialing
+	server.Close()
+	select {
+	case err := <-result:
+		assert.Equal(ErrServerClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("dialing not cancelled")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", ErrorCode(nil))
+	assert.Equal(CodeTimeout, ErrorCode(ErrTimeout))
+	assert.Equal(CodeOutboxFull, ErrorCode(fmt.Errorf("send failed: %w", ErrOutboxFull)))
+	assert.Equal(CodeError, ErrorCode(fmt.Errorf("something else")))
+
+	server := newTestServer(t, Options{Addr: "mem://test-error-code"})
+	_, err := server.OpenConnection("foo://somewhere")
+	assert.True(errors.Is(err, ErrUnknownScheme))
+	assert.Equal(CodeUnknownScheme, ErrorCode(err))
+}
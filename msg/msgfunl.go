@@ -1,6 +1,10 @@
 package msg
 
 import (
+	"time"
+
+	"github.com/anssihalmeaho/mzq/queue"
+
 	"github.com/anssihalmeaho/funl/funl"
 	"github.com/anssihalmeaho/funl/std"
 )
@@ -22,10 +26,46 @@ func InitMsg(interpreter *funl.Interpreter) (err error) {
 			Name:   "receive",
 			Getter: getReceive,
 		},
+		{
+			Name:   "receive-timeout",
+			Getter: getReceiveTimeout,
+		},
+		{
+			Name:   "conn-receive",
+			Getter: getConnReceive,
+		},
+		{
+			Name:   "events",
+			Getter: getEvents,
+		},
 		{
 			Name:   "msend",
 			Getter: getSend,
 		},
+		{
+			Name:   "call",
+			Getter: getCall,
+		},
+		{
+			Name:   "reply",
+			Getter: getReply,
+		},
+		{
+			Name:   "conn-state",
+			Getter: getConnState,
+		},
+		{
+			Name:   "conn-stats",
+			Getter: getConnStats,
+		},
+		{
+			Name:   "server-stats",
+			Getter: getServerStats,
+		},
+		{
+			Name:   "server-addrs",
+			Getter: getServerAddrs,
+		},
 		{
 			Name:   "close",
 			Getter: getClose,
@@ -55,9 +95,20 @@ func (server *OpaqueServer) Equals(with funl.OpaqueAPI) bool {
 	return false
 }
 
+// connAPI is implemented by Connection and ReconnectingConnection
+type connAPI interface {
+	Send(data string) error
+	Receive() (Msg, error)
+	ReceiveTimeout(timeout time.Duration) (Msg, error)
+	CallTimeout(data string, timeout time.Duration) (string, error)
+	Stats() ConnStats
+	State() ConnState
+	Close()
+}
+
 // OpaqueConn ...
 type OpaqueConn struct {
-	c *Connection
+	c connAPI
 }
 
 // TypeName ...
@@ -75,37 +126,76 @@ func (conn *OpaqueConn) Equals(with funl.OpaqueAPI) bool {
 	return false
 }
 
-func getClose(name string) std.StdFuncType {
+func getCall(name string) std.StdFuncType {
 	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
-		if l := len(arguments); l != 1 {
-			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		if l := len(arguments); l != 3 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need three", name, l)
 		}
 		if arguments[0].Kind != funl.OpaqueValue {
 			funl.RunTimeError2(frame, "%s: requires opaque value", name)
 		}
+		if arguments[1].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+		if arguments[2].Kind != funl.IntValue {
+			funl.RunTimeError2(frame, "%s: requires int value", name)
+		}
 
 		con := arguments[0].Data.(*OpaqueConn)
-		con.c.Close()
-		retVal = funl.Value{Kind: funl.BoolValue, Data: true}
+		reply, err := con.c.CallTimeout(arguments[1].Data.(string), time.Duration(arguments[2].Data.(int)))
+
+		var isOK bool
+		var errorText string
+		if err == nil {
+			isOK = true
+		} else {
+			errorText = err.Error()
+		}
+
+		values := []funl.Value{
+			{
+				Kind: funl.BoolValue,
+				Data: isOK,
+			},
+			{
+				Kind: funl.StringValue,
+				Data: errorText,
+			},
+			{
+				Kind: funl.StringValue,
+				Data: reply,
+			},
+			{
+				Kind: funl.StringValue,
+				Data: ErrorCode(err),
+			},
+		}
+		retVal = funl.MakeListOfValues(frame, values)
 		return
 	}
 }
 
-func getSend(name string) std.StdFuncType {
+func getReply(name string) std.StdFuncType {
 	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
-		if l := len(arguments); l != 2 {
-			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need two", name, l)
+		if l := len(arguments); l != 3 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need three", name, l)
 		}
 		if arguments[0].Kind != funl.OpaqueValue {
 			funl.RunTimeError2(frame, "%s: requires opaque value", name)
 		}
-		if arguments[1].Kind != funl.StringValue {
+		if arguments[1].Kind != funl.MapValue {
+			funl.RunTimeError2(frame, "%s: requires map value", name)
+		}
+		if arguments[2].Kind != funl.StringValue {
 			funl.RunTimeError2(frame, "%s: requires string value", name)
 		}
 
-		con := arguments[0].Data.(*OpaqueConn)
-		data := arguments[1].Data.(string)
-		err := con.c.Send(data)
+		opaqueserver := arguments[0].Data.(*OpaqueServer)
+		msgMap := OptionsToGoMap(frame, name, arguments[1])
+		var request Msg
+		request.FromAddr, _ = msgMap["from-addr"].(string)
+		request.CallID, _ = msgMap["call-id"].(string)
+		err := opaqueserver.server.Reply(request, arguments[2].Data.(string))
 
 		var isOK bool
 		var errorText string
@@ -124,13 +214,104 @@ func getSend(name string) std.StdFuncType {
 				Kind: funl.StringValue,
 				Data: errorText,
 			},
+			{
+				Kind: funl.StringValue,
+				Data: ErrorCode(err),
+			},
 		}
 		retVal = funl.MakeListOfValues(frame, values)
 		return
 	}
 }
 
-func getReceive(name string) std.StdFuncType {
+// makeMapOperands makes operands for map from names and values
+func makeMapOperands(names []string, values []funl.Value) []*funl.Item {
+	operands := []*funl.Item{}
+	for i, name := range names {
+		operands = append(operands,
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{Kind: funl.StringValue, Data: name},
+			},
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: values[i],
+			},
+		)
+	}
+	return operands
+}
+
+func getConnStats(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+
+		con := arguments[0].Data.(*OpaqueConn)
+		stats := con.c.Stats()
+		names := []string{
+			"outbox-depth",
+			"outbox-capacity",
+			"max-outbox-depth",
+			"sent-frames",
+			"sent-bytes",
+			"writes",
+			"compressed-messages",
+			"uncompressed-bytes",
+			"compressed-bytes",
+			"compression-ratio",
+			"reconnects",
+			"lost-datagrams",
+			"dropped-datagrams",
+			"send-throttled",
+			"send-throttle-time",
+			"recv-throttled",
+			"recv-throttle-time",
+		}
+		values := []funl.Value{
+			{Kind: funl.IntValue, Data: stats.OutboxDepth},
+			{Kind: funl.IntValue, Data: stats.OutboxCapacity},
+			{Kind: funl.IntValue, Data: stats.MaxOutboxDepth},
+			{Kind: funl.IntValue, Data: stats.SentFrames},
+			{Kind: funl.IntValue, Data: stats.SentBytes},
+			{Kind: funl.IntValue, Data: stats.Writes},
+			{Kind: funl.IntValue, Data: stats.CompressedMessages},
+			{Kind: funl.IntValue, Data: stats.UncompressedBytes},
+			{Kind: funl.IntValue, Data: stats.CompressedBytes},
+			{Kind: funl.FloatValue, Data: stats.CompressionRatio()},
+			{Kind: funl.IntValue, Data: stats.Reconnects},
+			{Kind: funl.IntValue, Data: stats.LostDatagrams},
+			{Kind: funl.IntValue, Data: stats.DroppedDatagrams},
+			{Kind: funl.IntValue, Data: stats.SendThrottle.Throttled},
+			{Kind: funl.IntValue, Data: int(stats.SendThrottle.ThrottleTime)},
+			{Kind: funl.IntValue, Data: stats.RecvThrottle.Throttled},
+			{Kind: funl.IntValue, Data: int(stats.RecvThrottle.ThrottleTime)},
+		}
+		retVal = funl.HandleMapOP(frame, makeMapOperands(names, values))
+		return
+	}
+}
+
+func getConnState(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+
+		con := arguments[0].Data.(*OpaqueConn)
+		retVal = funl.Value{Kind: funl.StringValue, Data: con.c.State().String()}
+		return
+	}
+}
+
+func getServerStats(name string) std.StdFuncType {
 	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
 		if l := len(arguments); l != 1 {
 			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
@@ -140,60 +321,273 @@ func getReceive(name string) std.StdFuncType {
 		}
 
 		opaqueserver := arguments[0].Data.(*OpaqueServer)
-		server := opaqueserver.server
-		message, err := server.Receive()
+		stats := opaqueserver.server.Stats()
+		names := []string{
+			"connections",
+			"accepted-connections",
+			"rejected-connections",
+			"oversized-frames",
+			"send-throttled",
+			"send-throttle-time",
+			"recv-throttled",
+			"recv-throttle-time",
+		}
+		values := []funl.Value{
+			{Kind: funl.IntValue, Data: stats.Connections},
+			{Kind: funl.IntValue, Data: stats.AcceptedConnections},
+			{Kind: funl.IntValue, Data: stats.RejectedConnections},
+			{Kind: funl.IntValue, Data: stats.OversizedFrames},
+			{Kind: funl.IntValue, Data: stats.SendThrottle.Throttled},
+			{Kind: funl.IntValue, Data: int(stats.SendThrottle.ThrottleTime)},
+			{Kind: funl.IntValue, Data: stats.RecvThrottle.Throttled},
+			{Kind: funl.IntValue, Data: int(stats.RecvThrottle.ThrottleTime)},
+		}
+		retVal = funl.HandleMapOP(frame, makeMapOperands(names, values))
+		return
+	}
+}
+
+func getServerAddrs(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+
+		opaqueserver := arguments[0].Data.(*OpaqueServer)
+		retVal = MakeStringList(frame, opaqueserver.server.Addrs())
+		return
+	}
+}
+
+// MakeStringList makes FunL list of strings
+func MakeStringList(frame *funl.Frame, strs []string) funl.Value {
+	values := []funl.Value{}
+	for _, s := range strs {
+		values = append(values, funl.Value{Kind: funl.StringValue, Data: s})
+	}
+	return funl.MakeListOfValues(frame, values)
+}
+
+// MakeMap makes FunL map from names (string keys) and values
+func MakeMap(frame *funl.Frame, names []string, values []funl.Value) funl.Value {
+	return funl.HandleMapOP(frame, makeMapOperands(names, values))
+}
+
+func getClose(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+
+		switch opaque := arguments[0].Data.(type) {
+		case *OpaqueConn:
+			opaque.c.Close()
+		case *OpaqueServer:
+			opaque.server.Close()
+		default:
+			funl.RunTimeError2(frame, "%s: requires connection or server", name)
+		}
+		retVal = funl.Value{Kind: funl.BoolValue, Data: true}
+		return
+	}
+}
+
+func getSend(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 2 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			funl.RunTimeError2(frame, "%s: requires string value", name)
+		}
+
+		con := arguments[0].Data.(*OpaqueConn)
+		data := arguments[1].Data.(string)
+		err := con.c.Send(data)
+
 		var isOK bool
 		var errorText string
-
 		if err == nil {
 			isOK = true
 		} else {
 			errorText = err.Error()
 		}
 
-		var messageOperands []*funl.Item
-		if isOK {
-			messageOperands = []*funl.Item{
-				&funl.Item{
-					Type: funl.ValueItem,
-					Data: funl.Value{
-						Kind: funl.StringValue,
-						Data: "from-addr",
-					},
+		values := []funl.Value{
+			{
+				Kind: funl.BoolValue,
+				Data: isOK,
+			},
+			{
+				Kind: funl.StringValue,
+				Data: errorText,
+			},
+			{
+				Kind: funl.StringValue,
+				Data: ErrorCode(err),
+			},
+		}
+		retVal = funl.MakeListOfValues(frame, values)
+		return
+	}
+}
+
+func makeReceiveResult(frame *funl.Frame, message Msg, err error) funl.Value {
+	var isOK bool
+	var errorText string
+
+	if err == nil {
+		isOK = true
+	} else {
+		errorText = err.Error()
+	}
+
+	var messageOperands []*funl.Item
+	if isOK {
+		messageOperands = []*funl.Item{
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{
+					Kind: funl.StringValue,
+					Data: "from-addr",
 				},
-				&funl.Item{
-					Type: funl.ValueItem,
-					Data: funl.Value{
-						Kind: funl.StringValue,
-						Data: message.FromAddr,
-					},
+			},
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{
+					Kind: funl.StringValue,
+					Data: message.FromAddr,
 				},
-				&funl.Item{
-					Type: funl.ValueItem,
-					Data: funl.Value{
-						Kind: funl.StringValue,
-						Data: "data",
-					},
+			},
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{
+					Kind: funl.StringValue,
+					Data: "data",
 				},
+			},
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{
+					Kind: funl.StringValue,
+					Data: message.Data,
+				},
+			},
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{
+					Kind: funl.StringValue,
+					Data: "call-id",
+				},
+			},
+			&funl.Item{
+				Type: funl.ValueItem,
+				Data: funl.Value{
+					Kind: funl.StringValue,
+					Data: message.CallID,
+				},
+			},
+			/*
 				&funl.Item{
 					Type: funl.ValueItem,
 					Data: funl.Value{
-						Kind: funl.StringValue,
-						Data: message.Data,
+						Kind: funl.OpaqueValue,
+						Data: std.NewOpaqueByteArray([]byte(message.Data)),
 					},
 				},
-				/*
-					&funl.Item{
-						Type: funl.ValueItem,
-						Data: funl.Value{
-							Kind: funl.OpaqueValue,
-							Data: std.NewOpaqueByteArray([]byte(message.Data)),
-						},
-					},
-				*/
+			*/
+		}
+	} else {
+		messageOperands = []*funl.Item{}
+	}
+
+	values := []funl.Value{
+		{
+			Kind: funl.BoolValue,
+			Data: isOK,
+		},
+		{
+			Kind: funl.StringValue,
+			Data: errorText,
+		},
+		funl.HandleMapOP(frame, messageOperands),
+		{
+			Kind: funl.StringValue,
+			Data: ErrorCode(err),
+		},
+	}
+	return funl.MakeListOfValues(frame, values)
+}
+
+func getConnReceive(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 && l != 2 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one or two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+
+		con := arguments[0].Data.(*OpaqueConn)
+		var message Msg
+		var err error
+		if len(arguments) == 2 {
+			if arguments[1].Kind != funl.IntValue {
+				funl.RunTimeError2(frame, "%s: requires int value", name)
 			}
+			message, err = con.c.ReceiveTimeout(time.Duration(arguments[1].Data.(int)))
 		} else {
-			messageOperands = []*funl.Item{}
+			message, err = con.c.Receive()
+		}
+		retVal = makeReceiveResult(frame, message, err)
+		return
+	}
+}
+
+func getEvents(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 && l != 2 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one or two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+		var timeout time.Duration
+		if len(arguments) == 2 {
+			if arguments[1].Kind != funl.IntValue {
+				funl.RunTimeError2(frame, "%s: requires int value", name)
+			}
+			timeout = time.Duration(arguments[1].Data.(int))
+		}
+
+		opaqueserver := arguments[0].Data.(*OpaqueServer)
+		event, err := opaqueserver.server.ReceiveEvent(timeout)
+
+		var isOK bool
+		var errorText string
+		var eventOperands []*funl.Item
+		if err == nil {
+			isOK = true
+			eventOperands = makeMapOperands(
+				[]string{"event", "addr", "reason"},
+				[]funl.Value{
+					{Kind: funl.StringValue, Data: event.Type.String()},
+					{Kind: funl.StringValue, Data: event.Addr},
+					{Kind: funl.StringValue, Data: event.Reason},
+				},
+			)
+		} else {
+			errorText = err.Error()
+			eventOperands = []*funl.Item{}
 		}
 
 		values := []funl.Value{
@@ -205,14 +599,18 @@ func getReceive(name string) std.StdFuncType {
 				Kind: funl.StringValue,
 				Data: errorText,
 			},
-			funl.HandleMapOP(frame, messageOperands),
+			funl.HandleMapOP(frame, eventOperands),
+			{
+				Kind: funl.StringValue,
+				Data: ErrorCode(err),
+			},
 		}
 		retVal = funl.MakeListOfValues(frame, values)
 		return
 	}
 }
 
-func getOpenConnection(name string) std.StdFuncType {
+func getReceiveTimeout(name string) std.StdFuncType {
 	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
 		if l := len(arguments); l != 2 {
 			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need two", name, l)
@@ -220,13 +618,72 @@ func getOpenConnection(name string) std.StdFuncType {
 		if arguments[0].Kind != funl.OpaqueValue {
 			funl.RunTimeError2(frame, "%s: requires opaque value", name)
 		}
+		if arguments[1].Kind != funl.IntValue {
+			funl.RunTimeError2(frame, "%s: requires int value", name)
+		}
+
+		opaqueserver := arguments[0].Data.(*OpaqueServer)
+		server := opaqueserver.server
+		message, err := server.ReceiveTimeout(time.Duration(arguments[1].Data.(int)))
+		retVal = makeReceiveResult(frame, message, err)
+		return
+	}
+}
+
+func getReceive(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 1 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
+
+		opaqueserver := arguments[0].Data.(*OpaqueServer)
+		server := opaqueserver.server
+		message, err := server.Receive()
+		retVal = makeReceiveResult(frame, message, err)
+		return
+	}
+}
+
+func getOpenConnection(name string) std.StdFuncType {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 2 && l != 3 {
+			funl.RunTimeError2(frame, "%s: wrong amount of arguments (%d), need two or three", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			funl.RunTimeError2(frame, "%s: requires opaque value", name)
+		}
 		if arguments[1].Kind != funl.StringValue {
 			funl.RunTimeError2(frame, "%s: requires string value", name)
 		}
 
+		var connOptions ConnOptions
+		var reconnect bool
+		if len(arguments) == 3 {
+			if arguments[2].Kind != funl.MapValue {
+				funl.RunTimeError2(frame, "%s: requires map value", name)
+			}
+			options := OptionsToGoMap(frame, name, arguments[2])
+			if err := connOptions.SetFromMap(options); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+			var err error
+			if reconnect, err = boolOption(options, "reconnect", false); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+
 		opaqueserver := arguments[0].Data.(*OpaqueServer)
 		server := opaqueserver.server
-		conn, err := server.OpenConnection(arguments[1].Data.(string))
+		var conn connAPI
+		var err error
+		if reconnect {
+			conn, err = server.OpenReconnectingConnection(arguments[1].Data.(string), connOptions)
+		} else {
+			conn, err = server.OpenConnectionWithOptions(arguments[1].Data.(string), connOptions)
+		}
 		var isOK bool
 		var errorText string
 
@@ -246,6 +703,10 @@ func getOpenConnection(name string) std.StdFuncType {
 				Data: errorText,
 			},
 			funl.Value{Kind: funl.OpaqueValue, Data: &OpaqueConn{c: conn}},
+			{
+				Kind: funl.StringValue,
+				Data: ErrorCode(err),
+			},
 		}
 		retVal = funl.MakeListOfValues(frame, values)
 		return
@@ -266,7 +727,11 @@ func getCreateServer(name string) std.StdFuncType {
 		if !addrFound {
 			funl.RunTimeError2(frame, "%s: addr not given in options", name)
 		}
-		server, err := CreateServer(Options{Addr: address.(string)})
+		serverOptions := Options{Addr: address.(string)}
+		if err := serverOptions.SetFromMap(options); err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		server, err := CreateServer(serverOptions)
 		if err != nil {
 			funl.RunTimeError2(frame, "%s: error (%v)", name, err)
 		}
@@ -307,5 +772,35 @@ func OptionsToGoMap(frame *funl.Frame, name string, mapVal funl.Value) map[strin
 			resultMap[keyv.Data.(string)] = valv.Data
 		}
 	}
+
+	// log records are put to queue given in options
+	if v, found := resultMap["log-queue"]; found {
+		q, ok := v.(*queue.OpaqueQueue)
+		if !ok {
+			funl.RunTimeError2(frame, "%s: log-queue is not queue", name)
+		}
+		resultMap["logger"] = newQueueLogger(frame, q.GetQinside())
+	}
 	return resultMap
 }
+
+// newQueueLogger makes logger which puts log records as maps to queue,
+// records are dropped if queue is full
+func newQueueLogger(frame *funl.Frame, q *queue.Queue) Logger {
+	return LoggerFunc(func(level LogLevel, message string, fields ...interface{}) {
+		fieldNames := []string{}
+		fieldValues := []funl.Value{}
+		for k, v := range LogFields(fields...) {
+			fieldNames = append(fieldNames, k)
+			fieldValues = append(fieldValues, funl.Value{Kind: funl.StringValue, Data: v})
+		}
+		names := []string{"time", "level", "msg", "fields"}
+		values := []funl.Value{
+			{Kind: funl.IntValue, Data: int(time.Now().UnixNano())},
+			{Kind: funl.StringValue, Data: level.String()},
+			{Kind: funl.StringValue, Data: message},
+			funl.HandleMapOP(frame, makeMapOperands(fieldNames, fieldValues)),
+		}
+		q.PutNoWait(funl.HandleMapOP(frame, makeMapOperands(names, values)))
+	})
+}
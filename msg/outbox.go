@@ -0,0 +1,243 @@
+package msg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrOutboxFull is returned when connection outbox is full
+var ErrOutboxFull = errors.New("outbox full")
+
+// default size of connection outbox (frames)
+const defaultOutboxSize = 100
+
+// maximum amount of bytes coalesced into one write
+const maxCoalesceBytes = 64 * 1024
+
+// outItem is frame waiting in outbox, result gets write result
+// (after frame is flushed to connection)
+type outItem struct {
+	b      []byte
+	result chan error
+}
+
+// ConnStats contains statistics of connection
+type ConnStats struct {
+	OutboxDepth    int
+	OutboxCapacity int
+	MaxOutboxDepth int
+	SentFrames     int
+	SentBytes      int
+	Writes         int
+
+	// compressed messages and their sizes before and after compression
+	CompressedMessages int
+	UncompressedBytes  int
+	CompressedBytes    int
+
+	// Reconnects is amount of times reconnecting connection is re-established
+	Reconnects int
+
+	// datagrams detected lost (by sequence numbers) and
+	// dropped locally (receive buffer full or send failed)
+	LostDatagrams    int
+	DroppedDatagrams int
+
+	// delays caused by rate limits
+	SendThrottle ThrottleStats
+	RecvThrottle ThrottleStats
+}
+
+// CompressionRatio returns ratio of compressed size to original size
+// of compressed messages (1.0 if nothing is compressed)
+func (stats ConnStats) CompressionRatio() float64 {
+	if stats.UncompressedBytes == 0 {
+		return 1.0
+	}
+	return float64(stats.CompressedBytes) / float64(stats.UncompressedBytes)
+}
+
+// Stats returns statistics of connection
+func (con *Connection) Stats() ConnStats {
+	con.lock.RLock()
+	defer con.lock.RUnlock()
+
+	stats := con.stats
+	stats.OutboxDepth = len(con.outbox)
+	stats.OutboxCapacity = cap(con.outbox)
+	if dc, isDatagram := con.Conn.(*udpConn); isDatagram {
+		stats.LostDatagrams, stats.DroppedDatagrams = dc.datagramStats()
+	}
+	return stats
+}
+
+func (con *Connection) updOutboxDepth() {
+	con.lock.Lock()
+	defer con.lock.Unlock()
+
+	if depth := len(con.outbox); depth > con.stats.MaxOutboxDepth {
+		con.stats.MaxOutboxDepth = depth
+	}
+}
+
+func (con *Connection) updSent(frames, bytes int) {
+	con.lock.Lock()
+	defer con.lock.Unlock()
+
+	con.stats.SentFrames += frames
+	con.stats.SentBytes += bytes
+	con.stats.Writes++
+}
+
+// enqueue puts frame to outbox, waits for free space in outbox if wait is true
+func (con *Connection) enqueue(b []byte, wait bool) <-chan error {
+	return con.enqueueContext(context.Background(), b, wait)
+}
+
+// enqueueContext is like enqueue but waiting for free space
+// in outbox ends when context is done
+func (con *Connection) enqueueContext(ctx context.Context, b []byte, wait bool) <-chan error {
+	item := outItem{
+		b:      b,
+		result: make(chan error, 1),
+	}
+	if con.isClosed() {
+		item.result <- ErrConnectionClosed
+		return item.result
+	}
+	if con.datagram && len(b)+udpHeaderSize > con.ServerRef.maxDatagramSize() {
+		item.result <- ErrFrameTooLarge
+		return item.result
+	}
+	if wait {
+		select {
+		case con.outbox <- item:
+		case <-con.done:
+			item.result <- ErrConnectionClosed
+		case <-ctx.Done():
+			item.result <- ctx.Err()
+		}
+	} else {
+		select {
+		case <-con.done:
+			item.result <- ErrConnectionClosed
+		case con.outbox <- item:
+		default:
+			item.result <- ErrOutboxFull
+		}
+	}
+	// writer may have drained outbox and stopped already
+	select {
+	case <-con.done:
+		con.drainOutbox()
+	default:
+	}
+	con.updOutboxDepth()
+	return item.result
+}
+
+// waitResult waits until frame is written or connection is closed
+func (con *Connection) waitResult(result <-chan error) error {
+	return con.waitResultContext(context.Background(), result)
+}
+
+// waitResultContext is like waitResult but waiting ends when context is done
+func (con *Connection) waitResultContext(ctx context.Context, result <-chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-con.done:
+		select {
+		case err := <-result:
+			return err
+		default:
+		}
+		return ErrConnectionClosed
+	}
+}
+
+// SendAsync puts message to outbox of connection without waiting,
+// returned channel gets result when message is written to connection
+// (ErrOutboxFull if outbox is full)
+func (con *Connection) SendAsync(data string) <-chan error {
+	return con.enqueue(con.encodeData(data, false), false)
+}
+
+// writer writes frames from outbox to connection, frames which are
+// already waiting in outbox are coalesced to same write and written
+// data is flushed when outbox gets empty
+func (con *Connection) writer() {
+	w := bufio.NewWriter(con.Conn)
+
+	for {
+		var item outItem
+		select {
+		case item = <-con.outbox:
+		case <-con.done:
+			con.drainOutbox()
+			return
+		}
+
+		batch := []outItem{item}
+		bytes := len(item.b)
+		// datagrams are not coalesced, each frame is one datagram
+		for !con.datagram && len(con.outbox) > 0 && bytes < maxCoalesceBytes {
+			item = <-con.outbox
+			batch = append(batch, item)
+			bytes += len(item.b)
+		}
+
+		if !con.throttleSend(bytes, len(batch)) {
+			// closed while waiting
+			for _, item := range batch {
+				item.result <- ErrConnectionClosed
+			}
+			con.drainOutbox()
+			return
+		}
+
+		if writeTimeout := con.ServerRef.Opt.WriteTimeout; writeTimeout > 0 {
+			con.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		var err error
+		for _, item := range batch {
+			if _, err = w.Write(item.b); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		con.updSent(len(batch), bytes)
+		if err != nil {
+			con.closeWithReason("write failed")
+		}
+
+		for _, item := range batch {
+			item.result <- err
+		}
+
+		if err != nil {
+			con.ServerRef.Log(LevelWarn, "Write failed", "addr", con.addr, "error", err)
+			con.ServerRef.sendEvent(EventError, con.addr, err.Error())
+			<-con.done
+			con.drainOutbox()
+			return
+		}
+	}
+}
+
+func (con *Connection) drainOutbox() {
+	for {
+		select {
+		case item := <-con.outbox:
+			item.result <- ErrConnectionClosed
+		default:
+			return
+		}
+	}
+}
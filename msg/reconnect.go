@@ -0,0 +1,339 @@
+package msg
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned when reconnecting connection is not connected
+var ErrNotConnected = errors.New("not connected")
+
+// default reconnecting options
+const (
+	defaultReconnectMinDelay = 100 * time.Millisecond
+	defaultReconnectMaxDelay = 30 * time.Second
+	defaultReconnectBuffer   = 100
+)
+
+// ConnState is state of connection
+type ConnState int
+
+// Connection states
+const (
+	StateConnecting ConnState = iota + 1
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (state ConnState) String() string {
+	switch state {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ReconnectingConnection is client connection which redials
+// when connection is lost, messages sent while disconnected
+// are buffered (up to ConnOptions.ReconnectBuffer messages)
+// and sent when connection is established again
+type ReconnectingConnection struct {
+	Addr      string
+	ServerRef *MessageServer
+
+	options    ConnOptions
+	current    *Connection
+	state      ConnState
+	buffer     []string
+	reconnects int
+	recChan    chan Msg
+	stateCh    chan ConnState
+	stop       chan struct{}
+	lock       sync.RWMutex
+}
+
+// OpenReconnectingConnection opens connection towards given address
+// which is re-established if it's lost, connecting is done in background
+func (server *MessageServer) OpenReconnectingConnection(addr string, options ConnOptions) (*ReconnectingConnection, error) {
+	if _, _, _, err := getTransport(addr); err != nil {
+		return nil, err
+	}
+	if options.ReconnectMinDelay <= 0 {
+		options.ReconnectMinDelay = defaultReconnectMinDelay
+	}
+	if options.ReconnectMaxDelay < options.ReconnectMinDelay {
+		options.ReconnectMaxDelay = defaultReconnectMaxDelay
+	}
+	if options.ReconnectBuffer <= 0 {
+		options.ReconnectBuffer = defaultReconnectBuffer
+	}
+	rc := &ReconnectingConnection{
+		Addr:      addr,
+		ServerRef: server,
+		options:   options,
+		state:     StateConnecting,
+		recChan:   make(chan Msg, 10),
+		stateCh:   make(chan ConnState, 10),
+		stop:      make(chan struct{}),
+	}
+	go rc.supervisor()
+	return rc, nil
+}
+
+func (rc *ReconnectingConnection) setState(state ConnState) {
+	rc.state = state
+
+	// non-blocking send
+	select {
+	case rc.stateCh <- state:
+	default:
+	}
+}
+
+// States returns channel from which state changes can be received,
+// state changes are dropped if channel is full
+func (rc *ReconnectingConnection) States() <-chan ConnState {
+	return rc.stateCh
+}
+
+// State returns current state of connection
+func (rc *ReconnectingConnection) State() ConnState {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	return rc.state
+}
+
+// backoff returns delay before next dialing attempt,
+// delay grows exponentially and has random jitter
+func (rc *ReconnectingConnection) backoff(attempt int) time.Duration {
+	delay := rc.options.ReconnectMaxDelay
+	if attempt < 32 {
+		if d := rc.options.ReconnectMinDelay << uint(attempt); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (rc *ReconnectingConnection) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-rc.stop:
+		return false
+	}
+}
+
+func (rc *ReconnectingConnection) supervisor() {
+	attempt := 0
+	for {
+		con, err := rc.ServerRef.OpenConnectionWithOptions(rc.Addr, rc.options)
+		if err == ErrServerClosed {
+			rc.Close()
+			return
+		}
+		if err != nil {
+			rc.lock.Lock()
+			if rc.state != StateClosed {
+				rc.setState(StateDisconnected)
+			}
+			rc.lock.Unlock()
+
+			if !rc.sleep(rc.backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		if rc.options.DirectReceive {
+			go rc.forwarder(con)
+		}
+		if !rc.flush(con) {
+			con.Close()
+			return
+		}
+
+		select {
+		case <-con.done:
+		case <-rc.stop:
+			con.Close()
+			return
+		}
+
+		rc.lock.Lock()
+		rc.current = nil
+		if rc.state == StateClosed {
+			rc.lock.Unlock()
+			return
+		}
+		rc.reconnects++
+		rc.setState(StateDisconnected)
+		rc.lock.Unlock()
+	}
+}
+
+// flush sends buffered messages to new connection and after that
+// takes connection into use, returns false if closed
+func (rc *ReconnectingConnection) flush(con *Connection) bool {
+	for {
+		rc.lock.Lock()
+		if rc.state == StateClosed {
+			rc.lock.Unlock()
+			return false
+		}
+		if len(rc.buffer) == 0 {
+			rc.current = con
+			rc.setState(StateConnected)
+			rc.lock.Unlock()
+			return true
+		}
+		buffered := rc.buffer
+		rc.buffer = nil
+		rc.lock.Unlock()
+
+		for i, data := range buffered {
+			if err := con.Send(data); err != nil {
+				// put unsent ones back to buffer, connection is lost again
+				rc.lock.Lock()
+				rc.buffer = append(buffered[i:], rc.buffer...)
+				rc.lock.Unlock()
+				return true
+			}
+		}
+	}
+}
+
+// forwarder forwards messages received from connection
+func (rc *ReconnectingConnection) forwarder(con *Connection) {
+	for {
+		select {
+		case msg := <-con.recChan:
+			// non-blocking send
+			select {
+			case rc.recChan <- msg:
+			default:
+			}
+		case <-con.done:
+			return
+		}
+	}
+}
+
+// bufferData buffers message while disconnected, needs to be called with lock
+func (rc *ReconnectingConnection) bufferData(data string) error {
+	if len(rc.buffer) >= rc.options.ReconnectBuffer {
+		return ErrOutboxFull
+	}
+	rc.buffer = append(rc.buffer, data)
+	return nil
+}
+
+// Send sends message to connection or buffers it if disconnected
+func (rc *ReconnectingConnection) Send(data string) error {
+	rc.lock.Lock()
+	switch {
+	case rc.state == StateClosed:
+		rc.lock.Unlock()
+		return ErrConnectionClosed
+	case rc.current == nil:
+		defer rc.lock.Unlock()
+		return rc.bufferData(data)
+	}
+	con := rc.current
+	rc.lock.Unlock()
+
+	err := con.Send(data)
+	if err != nil && con.State() == StateClosed {
+		// connection was lost, message is sent after reconnecting
+		rc.lock.Lock()
+		defer rc.lock.Unlock()
+		return rc.bufferData(data)
+	}
+	return err
+}
+
+// CallTimeout sends request and waits for reply at most given time,
+// fails if not connected
+func (rc *ReconnectingConnection) CallTimeout(data string, timeout time.Duration) (string, error) {
+	rc.lock.RLock()
+	con := rc.current
+	rc.lock.RUnlock()
+
+	if con == nil {
+		return "", ErrNotConnected
+	}
+	return con.CallTimeout(data, timeout)
+}
+
+// Receive receives message from connection,
+// connection needs to be opened with DirectReceive option
+func (rc *ReconnectingConnection) Receive() (Msg, error) {
+	select {
+	case msg := <-rc.recChan:
+		return msg, nil
+	case <-rc.stop:
+		return Msg{}, ErrConnectionClosed
+	}
+}
+
+// ReceiveTimeout receives message from connection, waiting at most given time
+func (rc *ReconnectingConnection) ReceiveTimeout(timeout time.Duration) (Msg, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-rc.recChan:
+		return msg, nil
+	case <-rc.stop:
+		return Msg{}, ErrConnectionClosed
+	case <-timer.C:
+		return Msg{}, ErrTimeout
+	}
+}
+
+// Stats returns statistics of current connection,
+// buffered messages are included in outbox depth
+func (rc *ReconnectingConnection) Stats() ConnStats {
+	rc.lock.RLock()
+	con := rc.current
+	buffered := len(rc.buffer)
+	reconnects := rc.reconnects
+	rc.lock.RUnlock()
+
+	var stats ConnStats
+	if con != nil {
+		stats = con.Stats()
+	}
+	stats.OutboxDepth += buffered
+	stats.Reconnects = reconnects
+	return stats
+}
+
+// Close closes connection, it's not re-established anymore
+func (rc *ReconnectingConnection) Close() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if rc.state == StateClosed {
+		return
+	}
+	rc.setState(StateClosed)
+	close(rc.stop)
+	if rc.current != nil {
+		rc.current.Close()
+	}
+}
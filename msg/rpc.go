@@ -0,0 +1,119 @@
+package msg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotRequest is returned when replying to message which is not request
+var ErrNotRequest = errors.New("message is not request")
+
+// Request and reply frames are control frames which contain
+// correlation ID and inner frame (data frame or compressed frame),
+// format of payload is: <call-id>:<inner frame>
+
+func taggedFrame(name, callID string, inner []byte) []byte {
+	return controlFrame(name, callID+":"+string(inner[:len(inner)-1]))
+}
+
+// splitTagged splits payload of request/reply to call ID and inner frame
+func splitTagged(payload string, maxSize int) (string, frame, error) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		return "", frame{}, fmt.Errorf("invalid call frame")
+	}
+	f, err := decodeFrame(parseFrame(append([]byte(parts[1]), 0)), maxSize)
+	if err != nil {
+		return "", frame{}, err
+	}
+	if f.isControl() {
+		return "", frame{}, fmt.Errorf("invalid call frame")
+	}
+	return parts[0], f, nil
+}
+
+func (con *Connection) addCall() (string, chan string) {
+	con.lock.Lock()
+	defer con.lock.Unlock()
+
+	con.callSeq++
+	callID := strconv.Itoa(con.callSeq)
+	replyCh := make(chan string, 1)
+	con.calls[callID] = replyCh
+	return callID, replyCh
+}
+
+func (con *Connection) removeCall(callID string) {
+	con.lock.Lock()
+	defer con.lock.Unlock()
+
+	delete(con.calls, callID)
+}
+
+func (con *Connection) handleReply(payload string) {
+	callID, f, err := splitTagged(payload, con.ServerRef.Opt.MaxFrameSize)
+	if err != nil {
+		con.ServerRef.sendEvent(EventError, con.addr, err.Error())
+		return
+	}
+
+	con.lock.Lock()
+	replyCh, found := con.calls[callID]
+	delete(con.calls, callID)
+	con.lock.Unlock()
+
+	// reply to call which is already timed out is dropped
+	if found {
+		replyCh <- f.data
+	}
+}
+
+// Call sends request to connection and waits for reply,
+// peer replies with MessageServer.Reply
+func (con *Connection) Call(ctx context.Context, data string) (string, error) {
+	callID, replyCh := con.addCall()
+	defer con.removeCall(callID)
+
+	request := taggedFrame(ctrlRequest, callID, con.encodeData(data, true))
+	err := con.waitResultContext(ctx, con.enqueueContext(ctx, request, true))
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case reply := <-replyCh:
+		return reply, nil
+	case <-con.done:
+		return "", ErrConnectionClosed
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// CallTimeout sends request to connection and waits for reply at most given time
+func (con *Connection) CallTimeout(data string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := con.Call(ctx, data)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reply, ErrTimeout
+	}
+	return reply, err
+}
+
+// Reply sends reply to request message (received with Receive)
+func (server *MessageServer) Reply(request Msg, data string) error {
+	if request.CallID == "" {
+		return ErrNotRequest
+	}
+	con, found := server.getConn(request.FromAddr)
+	if !found {
+		return ErrConnectionClosed
+	}
+	return con.waitResult(con.enqueue(taggedFrame(ctrlReply, request.CallID, con.encodeData(data, true)), true))
+}
@@ -0,0 +1,136 @@
+package msg
+
+import (
+	"time"
+)
+
+// RateLimit limits amount of bytes and messages (frames) per second,
+// bursts default to one second worth of rate (zero rate = no limit)
+type RateLimit struct {
+	BytesPerSec    float64
+	ByteBurst      int
+	MessagesPerSec float64
+	MessageBurst   int
+}
+
+// rateLimiter throttles traffic with byte and message token buckets,
+// nil rateLimiter has no limits
+type rateLimiter struct {
+	bytes    *tokenBucket
+	messages *tokenBucket
+}
+
+func newBucketWithDefault(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	return newTokenBucket(rate, burst)
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.BytesPerSec <= 0 && limit.MessagesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		bytes:    newBucketWithDefault(limit.BytesPerSec, limit.ByteBurst),
+		messages: newBucketWithDefault(limit.MessagesPerSec, limit.MessageBurst),
+	}
+}
+
+// reserve takes tokens for given traffic and returns time to wait
+func (rl *rateLimiter) reserve(bytes, messages int) time.Duration {
+	var wait time.Duration
+	if rl == nil {
+		return wait
+	}
+	if rl.bytes != nil {
+		wait = rl.bytes.reserve(float64(bytes))
+	}
+	if rl.messages != nil {
+		if d := rl.messages.reserve(float64(messages)); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// ThrottleStats tells how many times and how long traffic has been
+// delayed by rate limits
+type ThrottleStats struct {
+	Throttled    int
+	ThrottleTime time.Duration
+}
+
+func (stats *ThrottleStats) add(wait time.Duration) {
+	stats.Throttled++
+	stats.ThrottleTime += wait
+}
+
+// throttle waits as long as connection and server limits require,
+// returns false if connection is closed while waiting
+func (con *Connection) throttle(connLimiter, serverLimiter *rateLimiter, bytes, messages int, inbound bool) bool {
+	wait := connLimiter.reserve(bytes, messages)
+	if d := serverLimiter.reserve(bytes, messages); d > wait {
+		wait = d
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	con.lock.Lock()
+	if inbound {
+		con.stats.RecvThrottle.add(wait)
+	} else {
+		con.stats.SendThrottle.add(wait)
+	}
+	con.lock.Unlock()
+
+	server := con.ServerRef
+	server.lock.Lock()
+	if inbound {
+		server.stats.RecvThrottle.add(wait)
+	} else {
+		server.stats.SendThrottle.add(wait)
+	}
+	server.lock.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-con.done:
+		return false
+	}
+}
+
+// rateLimitOption reads rate limit from options with given prefix
+// (like "send-" -> 'send-rate', 'send-burst', 'send-msg-rate', 'send-msg-burst')
+func rateLimitOption(options map[string]interface{}, prefix string, limit RateLimit) (RateLimit, error) {
+	var err error
+	if limit.BytesPerSec, err = floatOption(options, prefix+"rate", limit.BytesPerSec); err != nil {
+		return limit, err
+	}
+	if limit.ByteBurst, err = intOption(options, prefix+"burst", limit.ByteBurst); err != nil {
+		return limit, err
+	}
+	if limit.MessagesPerSec, err = floatOption(options, prefix+"msg-rate", limit.MessagesPerSec); err != nil {
+		return limit, err
+	}
+	if limit.MessageBurst, err = intOption(options, prefix+"msg-burst", limit.MessageBurst); err != nil {
+		return limit, err
+	}
+	return limit, nil
+}
+
+func (con *Connection) throttleSend(bytes, messages int) bool {
+	return con.throttle(con.sendLimiter, con.ServerRef.sendLimiter, bytes, messages, false)
+}
+
+func (con *Connection) throttleRecv(bytes int) bool {
+	return con.throttle(con.recvLimiter, con.ServerRef.recvLimiter, bytes, 1, true)
+}
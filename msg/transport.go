@@ -0,0 +1,117 @@
+package msg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport provides listening and dialing of connections
+// for one address scheme (like "tcp" or "unix")
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// ContextDialer is implemented by transports which support
+// cancelling dialing (Dial is used otherwise)
+type ContextDialer interface {
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// DefaultScheme is used when address does not contain scheme
+const DefaultScheme = "tcp"
+
+// default time limit for opening connection
+const defaultDialTimeout = 10 * time.Second
+
+type netTransport struct {
+	network string
+}
+
+func (tr *netTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(tr.network, addr)
+}
+
+func (tr *netTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout(tr.network, addr, defaultDialTimeout)
+}
+
+func (tr *netTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, tr.network, addr)
+}
+
+// dial dials address with transport, dialing is cancelled if it takes
+// longer than dial timeout or server is closed
+func (server *MessageServer) dial(ctx context.Context, transport Transport, addr string) (net.Conn, error) {
+	dialer, ok := transport.(ContextDialer)
+	if !ok {
+		return transport.Dial(addr)
+	}
+	timeout := server.Opt.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-server.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := dialer.DialContext(ctx, addr)
+	if err != nil && server.isClosed() {
+		return nil, ErrServerClosed
+	}
+	return conn, err
+}
+
+var transports = struct {
+	byScheme map[string]Transport
+	sync.RWMutex
+}{
+	byScheme: map[string]Transport{
+		"tcp":  &netTransport{network: "tcp"},
+		"unix": &netTransport{network: "unix"},
+		"mem":  newMemTransport(),
+		"udp":  &udpTransport{},
+	},
+}
+
+// RegisterTransport registers transport for given address scheme
+func RegisterTransport(scheme string, transport Transport) {
+	transports.Lock()
+	defer transports.Unlock()
+
+	transports.byScheme[scheme] = transport
+}
+
+// SplitAddr splits address to scheme and transport specific address,
+// for example "unix:///run/app.sock" -> "unix", "/run/app.sock"
+func SplitAddr(addr string) (scheme string, transportAddr string) {
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) == 1 {
+		return DefaultScheme, addr
+	}
+	return parts[0], parts[1]
+}
+
+func getTransport(addr string) (Transport, string, string, error) {
+	scheme, transportAddr := SplitAddr(addr)
+
+	transports.RLock()
+	defer transports.RUnlock()
+
+	transport, found := transports.byScheme[scheme]
+	if !found {
+		return nil, "", "", fmt.Errorf("%w (%s)", ErrUnknownScheme, scheme)
+	}
+	return transport, scheme, transportAddr, nil
+}
@@ -0,0 +1,486 @@
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// udpTransport is best-effort datagram transport, addresses are like
+// "udp://host:port". Each frame is sent as one datagram so lost
+// datagrams do not block other messages. Server side connections
+// are created when first datagram is received from new address.
+type udpTransport struct{}
+
+// DatagramScheme is address scheme of UDP transport
+const DatagramScheme = "udp"
+
+// default maximum size of datagram (maximum UDP payload)
+const defaultMaxDatagramSize = 65507
+
+// defaults for closing idle accepted connections and
+// limiting amount of accepted connections
+const (
+	defaultDatagramIdleTimeout = 5 * time.Minute
+	defaultMaxDatagramConns    = 1024
+)
+
+// datagram header is flags byte and optional sequence number
+const (
+	udpFlagSequence = 1
+	udpHeaderSize   = 5
+	udpReadBuffer   = 64 * 1024
+	udpInboxSize    = 100
+	udpAcceptQueue  = 16
+)
+
+// withDatagramScheme adds datagram scheme to address
+// without scheme if datagram mode is on
+func withDatagramScheme(addr string, datagram bool) string {
+	if datagram && !strings.Contains(addr, "://") {
+		return DatagramScheme + "://" + addr
+	}
+	return addr
+}
+
+func (server *MessageServer) maxDatagramSize() int {
+	if server.Opt.MaxDatagramSize > 0 {
+		return server.Opt.MaxDatagramSize
+	}
+	return defaultMaxDatagramSize
+}
+
+func (server *MessageServer) datagramIdleTimeout() time.Duration {
+	if server.Opt.DatagramIdleTimeout > 0 {
+		return server.Opt.DatagramIdleTimeout
+	}
+	return defaultDatagramIdleTimeout
+}
+
+func (server *MessageServer) maxDatagramConns() int {
+	if server.Opt.MaxDatagramConns > 0 {
+		return server.Opt.MaxDatagramConns
+	}
+	return defaultMaxDatagramConns
+}
+
+func (tr *udpTransport) Listen(addr string) (net.Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	ln := &udpListener{
+		pc:          pc,
+		conns:       map[string]*udpConn{},
+		connCh:      make(chan net.Conn, udpAcceptQueue),
+		done:        make(chan struct{}),
+		idleTimeout: defaultDatagramIdleTimeout,
+		maxConns:    defaultMaxDatagramConns,
+	}
+	go ln.reader()
+	go ln.expirer()
+	return ln, nil
+}
+
+func (tr *udpTransport) Dial(addr string) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := newUDPConn(pc, udpAddr, nil)
+	go conn.reader()
+	return conn, nil
+}
+
+type udpListener struct {
+	pc        *net.UDPConn
+	conns     map[string]*udpConn
+	connCh    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lock        sync.Mutex
+	idleTimeout time.Duration
+	maxConns    int
+}
+
+// setLimits sets idle timeout and maximum amount of connections
+func (ln *udpListener) setLimits(idleTimeout time.Duration, maxConns int) {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+
+	ln.idleTimeout = idleTimeout
+	ln.maxConns = maxConns
+}
+
+// reader reads datagrams from listening socket and
+// delivers them to connections (by remote address)
+func (ln *udpListener) reader() {
+	buf := make([]byte, udpReadBuffer)
+	for {
+		n, remote, err := ln.pc.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if conn := ln.getConn(remote); conn != nil {
+			conn.deliver(append([]byte(nil), buf[:n]...))
+		}
+	}
+}
+
+// getConn returns connection for remote address, new connection is
+// created (and accepted) if there's none yet, returns nil if datagram
+// needs to be dropped
+func (ln *udpListener) getConn(remote *net.UDPAddr) *udpConn {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+
+	key := remote.String()
+	if conn, found := ln.conns[key]; found {
+		return conn
+	}
+	if len(ln.conns) >= ln.maxConns {
+		return nil
+	}
+	conn := newUDPConn(ln.pc, remote, ln)
+	select {
+	case ln.connCh <- conn:
+		ln.conns[key] = conn
+		return conn
+	default:
+		// acceptor is not keeping up
+		return nil
+	}
+}
+
+// expirer closes connections from which nothing
+// has been received during idle timeout
+func (ln *udpListener) expirer() {
+	for {
+		ln.lock.Lock()
+		timer := time.NewTimer(ln.idleTimeout / 2)
+		ln.lock.Unlock()
+
+		select {
+		case <-timer.C:
+		case <-ln.done:
+			timer.Stop()
+			return
+		}
+		for _, conn := range ln.idleConns() {
+			conn.Close()
+		}
+	}
+}
+
+func (ln *udpListener) idleConns() []*udpConn {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+
+	idle := []*udpConn{}
+	for _, conn := range ln.conns {
+		if conn.idleTime() >= ln.idleTimeout {
+			idle = append(idle, conn)
+		}
+	}
+	return idle
+}
+
+func (ln *udpListener) removeConn(conn *udpConn) {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+
+	if ln.conns[conn.remote.String()] == conn {
+		delete(ln.conns, conn.remote.String())
+	}
+}
+
+func (ln *udpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.connCh:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *udpListener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+		ln.pc.Close()
+
+		ln.lock.Lock()
+		conns := ln.conns
+		ln.conns = map[string]*udpConn{}
+		ln.lock.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+func (ln *udpListener) Addr() net.Addr {
+	return ln.pc.LocalAddr()
+}
+
+// udpConn is connection to one remote address, client side connection
+// has own socket and server side connections share listening socket
+type udpConn struct {
+	pc        *net.UDPConn
+	remote    *net.UDPAddr
+	listener  *udpListener
+	inbox     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	pending   []byte
+
+	// sequence numbers are added to sent datagrams if set
+	// (set before connection is used)
+	sequence bool
+
+	lock         sync.Mutex
+	sendSeq      uint32
+	recvSeq      uint32
+	seqStarted   bool
+	lost         int
+	dropped      int
+	readDeadline time.Time
+	deadlineCh   chan struct{}
+	lastReceived time.Time
+}
+
+func newUDPConn(pc *net.UDPConn, remote *net.UDPAddr, listener *udpListener) *udpConn {
+	return &udpConn{
+		pc:           pc,
+		remote:       remote,
+		listener:     listener,
+		inbox:        make(chan []byte, udpInboxSize),
+		done:         make(chan struct{}),
+		deadlineCh:   make(chan struct{}),
+		lastReceived: time.Now(),
+	}
+}
+
+// idleTime returns time since last received datagram
+func (conn *udpConn) idleTime() time.Duration {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	return time.Since(conn.lastReceived)
+}
+
+// reader reads datagrams from own socket of client side connection
+func (conn *udpConn) reader() {
+	buf := make([]byte, udpReadBuffer)
+	for {
+		n, err := conn.pc.Read(buf)
+		if err != nil {
+			select {
+			case <-conn.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// for example ICMP port unreachable, datagrams are best-effort
+			continue
+		}
+		conn.deliver(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// deliver checks header of received datagram and puts it to inbox,
+// datagrams are dropped if inbox is full
+func (conn *udpConn) deliver(datagram []byte) {
+	if len(datagram) < 1 {
+		return
+	}
+	conn.lock.Lock()
+	conn.lastReceived = time.Now()
+	conn.lock.Unlock()
+
+	payload := datagram[1:]
+	if datagram[0]&udpFlagSequence != 0 {
+		if len(datagram) < udpHeaderSize {
+			return
+		}
+		if !conn.checkSequence(binary.BigEndian.Uint32(datagram[1:udpHeaderSize])) {
+			return
+		}
+		payload = datagram[udpHeaderSize:]
+	}
+
+	select {
+	case conn.inbox <- payload:
+	default:
+		conn.lock.Lock()
+		conn.dropped++
+		conn.lock.Unlock()
+	}
+}
+
+// checkSequence counts lost datagrams from gaps in sequence numbers,
+// returns false for datagrams arriving late (after newer ones)
+func (conn *udpConn) checkSequence(seq uint32) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.seqStarted {
+		gap := int32(seq - conn.recvSeq)
+		if gap < 0 {
+			return false
+		}
+		conn.lost += int(gap)
+	}
+	conn.seqStarted = true
+	conn.recvSeq = seq + 1
+	return true
+}
+
+// datagramStats returns amount of lost and dropped datagrams
+func (conn *udpConn) datagramStats() (lost, dropped int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	return conn.lost, conn.dropped
+}
+
+func (conn *udpConn) Read(b []byte) (int, error) {
+	if len(conn.pending) > 0 {
+		n := copy(b, conn.pending)
+		conn.pending = conn.pending[n:]
+		return n, nil
+	}
+	for {
+		conn.lock.Lock()
+		deadline := conn.readDeadline
+		deadlineCh := conn.deadlineCh
+		conn.lock.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case payload := <-conn.inbox:
+			if timer != nil {
+				timer.Stop()
+			}
+			n := copy(b, payload)
+			conn.pending = payload[n:]
+			return n, nil
+		case <-conn.done:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-deadlineCh:
+			// deadline changed
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (conn *udpConn) Write(b []byte) (int, error) {
+	select {
+	case <-conn.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	datagram := make([]byte, 0, udpHeaderSize+len(b))
+	if conn.sequence {
+		conn.lock.Lock()
+		seq := conn.sendSeq
+		conn.sendSeq++
+		conn.lock.Unlock()
+
+		datagram = append(datagram, udpFlagSequence, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(datagram[1:], seq)
+	} else {
+		datagram = append(datagram, 0)
+	}
+	datagram = append(datagram, b...)
+
+	var err error
+	if conn.listener != nil {
+		_, err = conn.pc.WriteToUDP(datagram, conn.remote)
+	} else {
+		_, err = conn.pc.Write(datagram)
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return 0, err
+	}
+	if err != nil {
+		// for example peer not listening, datagram is dropped
+		conn.lock.Lock()
+		conn.dropped++
+		conn.lock.Unlock()
+	}
+	return len(b), nil
+}
+
+func (conn *udpConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		if conn.listener != nil {
+			conn.listener.removeConn(conn)
+		} else {
+			conn.pc.Close()
+		}
+	})
+	return nil
+}
+
+func (conn *udpConn) LocalAddr() net.Addr {
+	return conn.pc.LocalAddr()
+}
+
+func (conn *udpConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *udpConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *udpConn) SetReadDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.readDeadline = t
+	close(conn.deadlineCh)
+	conn.deadlineCh = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing as writing datagram does not block
+func (conn *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
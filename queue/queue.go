@@ -14,12 +14,13 @@ const (
 
 // Queue is queue
 type Queue struct {
-	state qState
-	head  int
-	tail  int
-	size  int
-	items []interface{}
-	lock  sync.Mutex
+	state  qState
+	head   int
+	tail   int
+	size   int
+	items  []interface{}
+	closed bool
+	lock   sync.Mutex
 }
 
 // NewQueue return new queue
@@ -36,13 +37,17 @@ func NewQueue(size int) *Queue {
 	}
 }
 
-// Get gets value from queue
+// Get gets value from queue, returns nil if queue is closed and empty
 func (q *Queue) Get() (v interface{}) {
 	for {
 		q.lock.Lock()
 		if q.state != empty {
 			break
 		}
+		if q.closed {
+			q.lock.Unlock()
+			return
+		}
 		q.lock.Unlock()
 	}
 
@@ -57,10 +62,14 @@ func (q *Queue) Get() (v interface{}) {
 	return
 }
 
-// Put puts value to queue
+// Put puts value to queue, value is dropped if queue is closed
 func (q *Queue) Put(v interface{}) {
 	for {
 		q.lock.Lock()
+		if q.closed {
+			q.lock.Unlock()
+			return
+		}
 		if q.state != full {
 			break
 		}
@@ -78,9 +87,10 @@ func (q *Queue) Put(v interface{}) {
 }
 
 // PutNoWait puts value to queue but does not wait if its full
+// (closed queue is handled as full)
 func (q *Queue) PutNoWait(v interface{}) (isFull bool) {
 	q.lock.Lock()
-	if q.state == full {
+	if q.state == full || q.closed {
 		q.lock.Unlock()
 		isFull = true
 		return
@@ -117,6 +127,23 @@ func (q *Queue) GetNoWait() (v interface{}, hasAny bool) {
 	return
 }
 
+// Close closes queue, values can't be put to closed queue but
+// values in queue can still be read
+func (q *Queue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+}
+
+// IsClosed returns true if queue is closed
+func (q *Queue) IsClosed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.closed
+}
+
 /*
 //Get gets value from queue
 func (q *Queue) Get() (v interface{}, found bool) {
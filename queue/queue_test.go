@@ -41,3 +41,21 @@ func TestALotOfStuff(t *testing.T) {
 	t.Logf("Rec.count = %d, Put count = %d", recCount, putCount)
 	assert.Equal(recCount, putCount)
 }
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewQueue(2)
+	q.Put(1)
+	assert.False(q.IsClosed())
+	q.Close()
+	assert.True(q.IsClosed())
+
+	// values are not added to closed queue
+	assert.True(q.PutNoWait(2))
+	q.Put(3)
+	assert.Equal(1, q.Get())
+	assert.Nil(q.Get())
+	_, hasAny := q.GetNoWait()
+	assert.False(hasAny)
+}
@@ -98,7 +98,11 @@ func GetGetQ(name string) std.StdFuncType {
 		}
 
 		que := arguments[0].Data.(*OpaqueQueue)
-		retVal = (que.q.Get()).(funl.Value)
+		v := que.q.Get()
+		if v == nil {
+			funl.RunTimeError2(frame, "%s: queue closed", name)
+		}
+		retVal = v.(funl.Value)
 		return
 	}
 }